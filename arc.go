@@ -0,0 +1,238 @@
+package smtpd
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC chain validation states (RFC 8617 section 4.4).
+const (
+	arcNone = "none"
+	arcPass = "pass"
+	arcFail = "fail"
+)
+
+// RFC 8617 section 4.2.1 limits a chain to 50 ARC sets.
+const maxARCInstances = 50
+
+// arcSet is one instance of the ARC header fields.
+type arcSet struct {
+	aar, ams, seal *headerField
+	sealTags       map[string]string
+}
+
+// arcSets returns the ARC sets of msg ordered by instance, starting at i=1.
+// It fails if the sets are incomplete, duplicated or not numbered contiguously.
+func arcSets(msg *message) ([]arcSet, error) {
+	sets := make(map[int]*arcSet)
+	set := func(instance int) *arcSet {
+		if sets[instance] == nil {
+			sets[instance] = &arcSet{}
+		}
+		return sets[instance]
+	}
+
+	for i := range msg.header {
+		f := &msg.header[i]
+		var slot **headerField
+		name := strings.ToLower(f.name)
+		if name != "arc-authentication-results" && name != "arc-message-signature" && name != "arc-seal" {
+			continue
+		}
+		instance, err := arcInstance(f.value())
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "arc-authentication-results":
+			slot = &set(instance).aar
+		case "arc-message-signature":
+			slot = &set(instance).ams
+		case "arc-seal":
+			slot = &set(instance).seal
+		}
+		if *slot != nil {
+			return nil, fmt.Errorf("arc: duplicate %s for instance %d", f.name, instance)
+		}
+		*slot = f
+	}
+
+	if len(sets) > maxARCInstances {
+		return nil, errors.New("arc: too many ARC sets")
+	}
+	chain := make([]arcSet, len(sets))
+	for i := range chain {
+		set, ok := sets[i+1]
+		if !ok || set.aar == nil || set.ams == nil || set.seal == nil {
+			return nil, fmt.Errorf("arc: incomplete ARC set for instance %d", i+1)
+		}
+		tags, err := parseTags(set.seal.value())
+		if err != nil {
+			return nil, err
+		}
+		set.sealTags = tags
+		chain[i] = *set
+	}
+	return chain, nil
+}
+
+// arcInstance returns the value of the i= tag leading an ARC field.
+func arcInstance(value string) (int, error) {
+	if idx := strings.Index(value, ";"); idx != -1 {
+		value = value[:idx]
+	}
+	value = strings.TrimSpace(value)
+	if !strings.HasPrefix(value, "i=") {
+		return 0, errors.New("arc: missing instance tag")
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(value[2:]))
+	if err != nil || i < 1 || i > maxARCInstances {
+		return 0, fmt.Errorf("arc: invalid instance %q", value)
+	}
+	return i, nil
+}
+
+// verifyARC validates the ARC chain of msg (RFC 8617 section 5.2) and returns
+// its status: arcNone if there is no chain, arcPass or arcFail.
+func verifyARC(msg *message, lookupTXT func(string) ([]string, error)) string {
+	chain, err := arcSets(msg)
+	if err != nil {
+		return arcFail
+	}
+	if len(chain) == 0 {
+		return arcNone
+	}
+	if chain[len(chain)-1].sealTags["cv"] == arcFail {
+		return arcFail
+	}
+
+	// Only the most recent ARC-Message-Signature has to be valid.
+	if err = verifySignature(msg, *chain[len(chain)-1].ams, lookupTXT); err != nil {
+		return arcFail
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		want := arcPass
+		if i == 0 {
+			want = arcNone
+		}
+		if chain[i].sealTags["cv"] != want {
+			return arcFail
+		}
+		if err = verifySeal(chain[:i+1], lookupTXT); err != nil {
+			return arcFail
+		}
+	}
+	return arcPass
+}
+
+// verifySeal checks the ARC-Seal of the last set in chain.
+func verifySeal(chain []arcSet, lookupTXT func(string) ([]string, error)) error {
+	tags := chain[len(chain)-1].sealTags
+	for _, name := range []string{"a", "b", "d", "s"} {
+		if tags[name] == "" {
+			return fmt.Errorf("arc: missing %s= tag", name)
+		}
+	}
+	if _, ok := tags["h"]; ok {
+		return errors.New("arc: h= tag not allowed in ARC-Seal")
+	}
+
+	pub, err := lookupKey(lookupTXT, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	return verifyDigest(pub, tags["a"], sealDigest(chain), tags["b"])
+}
+
+// sealDigest hashes the ARC sets in chain as signed by the last ARC-Seal,
+// whose own signature is left out.
+func sealDigest(chain []arcSet) []byte {
+	h := sha256.New()
+	for i, set := range chain {
+		io.WriteString(h, relaxedHeader(set.aar.raw))
+		io.WriteString(h, relaxedHeader(set.ams.raw))
+		if i < len(chain)-1 {
+			io.WriteString(h, relaxedHeader(set.seal.raw))
+		} else {
+			io.WriteString(h, strings.TrimSuffix(relaxedHeader(unsignedField(*set.seal).raw), "\r\n"))
+		}
+	}
+	return h.Sum(nil)
+}
+
+// sealARC adds a new ARC set to msg recording results and the validation
+// status cv of the existing chain (RFC 8617 section 5.1). A message whose
+// chain has reached the maximum length is left unsealed.
+func sealARC(opts *DKIMOptions, msg *message, authservID string, results []AuthResult, cv string) error {
+	chain, err := arcSets(msg)
+	if err != nil {
+		cv = arcFail
+	}
+
+	// Find the next instance even if the chain is broken.
+	instance := 1
+	for _, f := range msg.header {
+		if strings.HasPrefix(strings.ToLower(f.name), "arc-") {
+			if i, err := arcInstance(f.value()); err == nil && i >= instance {
+				instance = i + 1
+			}
+		}
+	}
+	if instance > maxARCInstances {
+		return nil
+	}
+
+	algo, err := opts.algorithm()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	prefix := fmt.Sprintf("i=%d; ", instance)
+
+	aar := newHeaderField("ARC-Authentication-Results", prefix+formatAuthResults(authservID, results, msg.eol+"\t"), msg.eol)
+
+	// The ARC-Message-Signature must never sign ARC-Seal fields.
+	amsOpts := *opts
+	amsOpts.Headers, amsOpts.Oversign = nil, nil
+	headers := opts.Headers
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+	for _, name := range headers {
+		if !strings.EqualFold(name, "ARC-Seal") {
+			amsOpts.Headers = append(amsOpts.Headers, name)
+		}
+	}
+	for _, name := range opts.Oversign {
+		if !strings.EqualFold(name, "ARC-Seal") {
+			amsOpts.Oversign = append(amsOpts.Oversign, name)
+		}
+	}
+	ams, err := amsOpts.signature("ARC-Message-Signature", prefix, msg, now)
+	if err != nil {
+		return err
+	}
+
+	seal := newHeaderField("ARC-Seal", fmt.Sprintf("%sa=%s; t=%d; cv=%s;%sd=%s; s=%s;%sb=",
+		prefix, algo, now.Unix(), cv, msg.eol+"\t", opts.Domain, opts.Selector, msg.eol+"\t"), "")
+
+	// Once the chain has failed the new seal covers only its own set.
+	if cv == arcFail {
+		chain = nil
+	}
+	chain = append(chain, arcSet{aar: &aar, ams: &ams, seal: &seal})
+	b, err := signDigest(opts.Key, sealDigest(chain))
+	if err != nil {
+		return err
+	}
+	seal.raw += foldBase64(b, msg.eol) + msg.eol
+
+	msg.prepend(seal, ams, aar)
+	return nil
+}
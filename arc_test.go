@@ -0,0 +1,207 @@
+package smtpd
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// Publish the test certificate key as the DKIM key for every selector.
+func testLookupTXT(name string) ([]string, error) {
+	if !strings.HasSuffix(name, "._domainkey.example.com") {
+		return nil, errors.New("no such host")
+	}
+	der, err := x509.MarshalPKIXPublicKey(cert.PrivateKey.(*rsa.PrivateKey).Public())
+	if err != nil {
+		return nil, err
+	}
+	return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}, nil
+}
+
+// Send a message through server and return it as passed to the handler.
+func relayMessage(t *testing.T, server *Server, msg string) string {
+	var received string
+	server.Handler = func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		received = string(b)
+		return err
+	}
+
+	sendMessage(t, server, strings.TrimRight(msg, "\r\n"), 250, "list@example.com")
+	return received
+}
+
+func TestFormatAuthResults(t *testing.T) {
+	tests := []struct {
+		results []AuthResult
+		want    string
+	}{
+		{nil, "mx.example.com; none"},
+		{
+			[]AuthResult{
+				{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": "sender@example.com"}},
+				{Method: "dkim", Result: "fail", Reason: "body hash did not verify", Properties: map[string]string{"header.s": "test", "header.d": "example.com"}},
+			},
+			`mx.example.com; spf=pass smtp.mailfrom=sender@example.com; dkim=fail reason="body hash did not verify" header.d=example.com header.s=test`,
+		},
+	}
+	for _, tt := range tests {
+		if got := FormatAuthResults("mx.example.com", tt.results); got != tt.want {
+			t.Errorf("FormatAuthResults() returned %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestAuthResults(t *testing.T) {
+	server := &Server{
+		Hostname: "mx.example.com",
+		AuthResults: func(info *SessionInfo, from string, header textproto.MIMEHeader, dkim []AuthResult) ([]AuthResult, error) {
+			if header.Get("From") != "sender@example.com" {
+				t.Errorf("AuthResults received From %q", header.Get("From"))
+			}
+			return []AuthResult{{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.mailfrom": from}}}, nil
+		},
+	}
+
+	received := relayMessage(t, server, "Authentication-Results: MX.example.com; spf=pass\r\n"+
+		"Authentication-Results: other.example.net 1; dkim=pass\r\n"+
+		"Authentication-Results: (forged) mx.example.com; dkim=pass\r\n"+
+		"From: sender@example.com\r\n\r\nTest message.\r\n")
+
+	want := "Authentication-Results: mx.example.com;\n\tspf=pass smtp.mailfrom=sender@example.com\n" +
+		"Authentication-Results: other.example.net 1; dkim=pass\n" +
+		"From: sender@example.com\n\nTest message.\n"
+	if received != want {
+		t.Errorf("received message\n%q, want\n%q", received, want)
+	}
+}
+
+func TestAuthResultsDKIM(t *testing.T) {
+	key := cert.PrivateKey.(*rsa.PrivateKey)
+	signed := relayMessage(t, &Server{DKIM: func(info *SessionInfo, from string) (*DKIMOptions, error) {
+		return &DKIMOptions{Domain: "example.com", Selector: "test", Key: key}, nil
+	}}, "From: sender@example.com\r\nSubject: Hello\r\n\r\nTest message.\r\n")
+
+	var helo string
+	var dkim []AuthResult
+	server := &Server{
+		Hostname:  "mx.example.com",
+		LookupTXT: testLookupTXT,
+		AuthResults: func(info *SessionInfo, from string, header textproto.MIMEHeader, results []AuthResult) ([]AuthResult, error) {
+			helo, dkim = info.Helo, results
+			return []AuthResult{{Method: "spf", Result: "pass", Properties: map[string]string{"smtp.helo": info.Helo}}}, nil
+		},
+	}
+	received := relayMessage(t, server, signed)
+	if helo != "host.example.com" || len(dkim) != 1 || dkim[0].Result != "pass" || dkim[0].Properties["header.d"] != "example.com" {
+		t.Errorf("AuthResults called with HELO %q and %+v", helo, dkim)
+	}
+	if !strings.HasPrefix(received, "Authentication-Results: mx.example.com;\n\tdkim=pass header.b=") ||
+		!strings.Contains(received, " header.d=example.com header.s=test;\n\tspf=pass smtp.helo=host.example.com\n") {
+		t.Errorf("received message %q", received)
+	}
+
+	relayMessage(t, server, strings.Replace(signed, "Test message.", "Modified message.", 1))
+	if len(dkim) != 1 || dkim[0].Result != "fail" || dkim[0].Reason != "body hash did not verify" {
+		t.Errorf("AuthResults called with %+v for a modified message", dkim)
+	}
+}
+
+func TestARC(t *testing.T) {
+	key := cert.PrivateKey.(*rsa.PrivateKey)
+	newServer := func(hostname string) *Server {
+		return &Server{
+			Hostname:  hostname,
+			LookupTXT: testLookupTXT,
+			ARC: func(info *SessionInfo, from string) (*DKIMOptions, error) {
+				return &DKIMOptions{Domain: "example.com", Selector: hostname, Key: key}, nil
+			},
+		}
+	}
+	original := "From: sender@example.com\r\nSubject: Hello\r\n\r\nTest message.\r\n"
+
+	// The first hop has no chain to verify.
+	hop1 := relayMessage(t, newServer("one"), original)
+	if !strings.HasPrefix(hop1, "ARC-Seal: i=1; a=rsa-sha256;") || !strings.Contains(hop1, "\nAuthentication-Results: one;\n\tarc=none\n") {
+		t.Fatalf("first hop returned %q", hop1)
+	}
+	if !strings.Contains(hop1, "cv=none;") {
+		t.Errorf("first ARC-Seal has no cv=none tag: %q", hop1)
+	}
+
+	// Later hops validate and extend the chain.
+	hop2 := relayMessage(t, newServer("two"), hop1)
+	if !strings.HasPrefix(hop2, "ARC-Seal: i=2;") || !strings.Contains(hop2, "\nAuthentication-Results: two;\n\tarc=pass\n") {
+		t.Fatalf("second hop returned %q", hop2)
+	}
+	if !strings.Contains(hop2, "ARC-Authentication-Results: i=2; two;\n\tarc=pass\n") {
+		t.Errorf("second hop did not record the ARC result: %q", hop2)
+	}
+	hop3 := relayMessage(t, newServer("three"), hop2)
+	if !strings.HasPrefix(hop3, "ARC-Seal: i=3;") || !strings.Contains(hop3, "\nAuthentication-Results: three;\n\tarc=pass\n") {
+		t.Fatalf("third hop returned %q", hop3)
+	}
+
+	// A modified message breaks the chain.
+	tampered := strings.Replace(hop2, "Test message.", "Modified message.", 1)
+	hop3 = relayMessage(t, newServer("three"), tampered)
+	if !strings.HasPrefix(hop3, "ARC-Seal: i=3;") || !strings.Contains(hop3, "cv=fail;") || !strings.Contains(hop3, "\nAuthentication-Results: three;\n\tarc=fail\n") {
+		t.Errorf("tampered message returned %q", hop3)
+	}
+
+	// Without sealing options the chain is only verified.
+	server := newServer("three")
+	server.ARC = func(info *SessionInfo, from string) (*DKIMOptions, error) { return nil, nil }
+	hop3 = relayMessage(t, server, hop2)
+	if !strings.HasPrefix(hop3, "Authentication-Results: three;\n\tarc=pass\nARC-Seal: i=2;") {
+		t.Errorf("verification only returned %q", hop3)
+	}
+}
+
+// The chain is verified before the message is rewritten, and sealed after.
+func TestARCRewrite(t *testing.T) {
+	key := cert.PrivateKey.(*rsa.PrivateKey)
+	newServer := func(hostname string) *Server {
+		return &Server{
+			Hostname:  hostname,
+			LookupTXT: testLookupTXT,
+			ARC: func(info *SessionInfo, from string) (*DKIMOptions, error) {
+				return &DKIMOptions{Domain: "example.com", Selector: hostname, Key: key}, nil
+			},
+		}
+	}
+	hop1 := relayMessage(t, newServer("one"), "From: sender@example.com\r\nSubject: Hello\r\n\r\nTest message.\r\n")
+
+	server := newServer("two")
+	server.AuthResults = func(info *SessionInfo, from string, header textproto.MIMEHeader, dkim []AuthResult) ([]AuthResult, error) {
+		if header.Get("From") != "sender@example.com" {
+			t.Errorf("AuthResults received From %q", header.Get("From"))
+		}
+		return nil, nil
+	}
+	server.HeaderPolicy = &HeaderPolicy{Submission: func(info *SessionInfo) bool { return true }}
+	server.SenderPolicy = &SenderPolicy{
+		User:       func(info *SessionInfo) string { return "alice" },
+		Identities: func(user string) ([]string, error) { return []string{"alice@example.com"}, nil },
+		Rewrite:    true,
+	}
+	hop2 := relayMessage(t, server, hop1)
+	if !strings.HasPrefix(hop2, "ARC-Seal: i=2;") || !strings.Contains(hop2, "\nAuthentication-Results: two;\n\tarc=pass\n") {
+		t.Fatalf("second hop returned %q", hop2)
+	}
+	if !strings.Contains(hop2, "\nFrom: <alice@example.com>\n") || !strings.Contains(hop2, "\nMessage-ID: <") {
+		t.Errorf("second hop did not rewrite the message: %q", hop2)
+	}
+
+	hop3 := relayMessage(t, newServer("three"), hop2)
+	if !strings.Contains(hop3, "\nAuthentication-Results: three;\n\tarc=pass\n") {
+		t.Errorf("seal of rewritten message did not verify: %q", hop3)
+	}
+}
@@ -0,0 +1,191 @@
+package smtpd
+
+import (
+	"crypto/rsa"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// AuthResult is the outcome of one authentication method, as recorded in an
+// Authentication-Results field (RFC 8601).
+type AuthResult struct {
+	Method     string            // e.g. "spf", "dkim", "dmarc" or "arc"
+	Result     string            // e.g. "pass", "fail", "softfail" or "none"
+	Reason     string            // Optional explanation of the result
+	Properties map[string]string // e.g. "smtp.mailfrom" or "header.d", written in sorted order
+}
+
+// AuthResultsLookup is called for every message accepted by the server and
+// returns the results of the authentication checks (such as SPF and DMARC)
+// performed for it. The session gives the client address and HELO name, and
+// dkim the results of verifying the DKIM signatures of the message, which are
+// recorded ahead of those returned.
+type AuthResultsLookup func(info *SessionInfo, from string, header textproto.MIMEHeader, dkim []AuthResult) ([]AuthResult, error)
+
+// Maximum number of DKIM signatures verified in a message.
+const maxDKIMSignatures = 5
+
+// verifyDKIM checks the DKIM-Signature fields of msg and returns a result for
+// each (RFC 8601 section 2.7.1).
+func verifyDKIM(msg *message, lookupTXT func(string) ([]string, error)) []AuthResult {
+	var results []AuthResult
+	for i, sig := range msg.get("DKIM-Signature") {
+		if i == maxDKIMSignatures {
+			break
+		}
+		r := AuthResult{Method: "dkim", Result: "pass", Properties: make(map[string]string)}
+		if tags, err := parseTags(sig.value()); err == nil {
+			if tags["d"] != "" {
+				r.Properties["header.d"] = tags["d"]
+			}
+			if tags["s"] != "" {
+				r.Properties["header.s"] = tags["s"]
+			}
+			// The start of the signature tells several from one domain apart (RFC 6008).
+			if b := stripFWS(tags["b"]); len(b) >= 8 {
+				r.Properties["header.b"] = b[:8]
+			}
+		}
+		if err := verifySignature(msg, sig, lookupTXT); err != nil {
+			r.Result, r.Reason = dkimResult(err), strings.TrimPrefix(err.Error(), "dkim: ")
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// Return the DKIM result for a verification error.
+func dkimResult(err error) string {
+	if dnsErr, ok := err.(*net.DNSError); ok && (dnsErr.Temporary() || dnsErr.Timeout()) {
+		return "temperror"
+	}
+	if err == errBodyHash || err == errSignature || err == rsa.ErrVerification {
+		return "fail"
+	}
+	return "permerror"
+}
+
+// String formats the result as a resinfo clause, e.g. "spf=pass smtp.mailfrom=example.com".
+func (r AuthResult) String() string {
+	s := r.Method + "=" + r.Result
+	if r.Reason != "" {
+		s += " reason=" + quoteAuthValue(r.Reason, true)
+	}
+	keys := make([]string, 0, len(r.Properties))
+	for k := range r.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += " " + k + "=" + quoteAuthValue(r.Properties[k], false)
+	}
+	return s
+}
+
+// FormatAuthResults returns the value of an Authentication-Results field
+// for the given authserv-id. An empty result list is written as "none".
+func FormatAuthResults(authservID string, results []AuthResult) string {
+	return formatAuthResults(authservID, results, " ")
+}
+
+// formatAuthResults joins the clauses with sep, which may fold the field.
+func formatAuthResults(authservID string, results []AuthResult, sep string) string {
+	if len(results) == 0 {
+		return authservID + "; none"
+	}
+	clauses := make([]string, len(results))
+	for i, r := range results {
+		clauses[i] = r.String()
+	}
+	return authservID + ";" + sep + strings.Join(clauses, ";"+sep)
+}
+
+// quoteAuthValue quotes v if it is not a valid token (RFC 2045).
+// Property values may also be unquoted email addresses.
+func quoteAuthValue(v string, always bool) string {
+	if !always && v != "" && !strings.ContainsAny(v, " \t\"();,:<>[]\\/?=") {
+		return v
+	}
+	return `"` + strings.Replace(strings.Replace(v, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+// parseAuthServID returns the authserv-id of an Authentication-Results field value.
+func parseAuthServID(value string) string {
+	if idx := strings.Index(value, ";"); idx != -1 {
+		value = value[:idx]
+	}
+	// Skip comments and the optional version number following the authserv-id.
+	for {
+		start := strings.Index(value, "(")
+		end := strings.Index(value, ")")
+		if start == -1 || end < start {
+			break
+		}
+		value = value[:start] + " " + value[end+1:]
+	}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(fields[0], `"`)
+}
+
+// stripAuthResults removes Authentication-Results fields claiming to be from
+// authservID, which can only have been forged (RFC 8601 section 5).
+func stripAuthResults(msg *message, authservID string) {
+	msg.remove(func(f headerField) bool {
+		return strings.EqualFold(f.name, "Authentication-Results") && strings.EqualFold(parseAuthServID(f.value()), authservID)
+	})
+}
+
+// authFilters returns the message filters recording authentication results.
+// The first strips forged Authentication-Results fields, verifies the DKIM
+// signatures and any ARC chain and adds a new Authentication-Results field. The second, nil unless
+// ARC is configured, seals the message and must run after every filter that
+// modifies it.
+func (srv *Server) authFilters(info *SessionInfo) (check messageFilter, seal messageFilter) {
+	var results []AuthResult
+	cv := arcNone
+
+	check = func(remoteAddr net.Addr, from string, to []string, msg *message) error {
+		results = verifyDKIM(msg, srv.lookupTXT())
+		if srv.AuthResults != nil {
+			more, err := srv.AuthResults(info, from, msg.mimeHeader(), results)
+			if err != nil {
+				return err
+			}
+			results = append(results, more...)
+		}
+		if srv.ARC != nil {
+			cv = verifyARC(msg, srv.lookupTXT())
+			results = append(results, AuthResult{Method: "arc", Result: cv})
+		}
+
+		id := srv.authServID()
+		stripAuthResults(msg, id)
+		msg.prepend(newHeaderField("Authentication-Results", formatAuthResults(id, results, msg.eol+"\t"), msg.eol))
+		return nil
+	}
+
+	if srv.ARC == nil {
+		return check, nil
+	}
+	seal = func(remoteAddr net.Addr, from string, to []string, msg *message) error {
+		opts, err := srv.ARC(info, from)
+		if err != nil || opts == nil {
+			return err
+		}
+		return sealARC(opts, msg, srv.authServID(), results, cv)
+	}
+	return check, seal
+}
+
+// Return the authserv-id used in Authentication-Results fields.
+func (srv *Server) authServID() string {
+	if srv.AuthServID != "" {
+		return srv.AuthServID
+	}
+	return srv.Hostname
+}
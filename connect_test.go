@@ -0,0 +1,55 @@
+package smtpd
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestHandlerConnect(t *testing.T) {
+	var err error
+	var info *SessionInfo
+	server := &Server{
+		Hostname: "mx.example.com",
+		Appname:  "smtpd",
+		HandlerConnect: func(i *SessionInfo) error {
+			info = i
+			return err
+		},
+	}
+
+	tests := []struct {
+		err  error
+		code int
+		msg  string
+	}{
+		{nil, 220, "mx.example.com smtpd ESMTP Service ready"},
+		{&Error{Code: 554, EnhancedCode: "5.7.1", Message: "Client blocked"}, 554, "5.7.1 Client blocked"},
+		{ErrConnectRejected, 554, "5.7.1 Client host rejected"},
+		{&Error{Code: 421, EnhancedCode: "4.3.2", Message: "Down for maintenance"}, 421, "4.3.2 Down for maintenance"},
+		{errors.New("database unavailable"), 421, "4.3.0 mx.example.com Service not available, closing transmission channel"},
+	}
+	for _, tt := range tests {
+		err = tt.err
+		clientConn, serverConn := net.Pipe()
+		clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+		serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+		go server.newSession(serverConn).serve()
+		conn := textproto.NewConn(clientConn)
+
+		if _, msg, rerr := conn.ReadResponse(tt.code); rerr != nil || msg != tt.msg {
+			t.Errorf("greeting %q, %v; want %d %q", msg, rerr, tt.code, tt.msg)
+		}
+		if info == nil || info.RemoteAddr == nil || info.LocalAddr == nil || info.RemoteHost == "" {
+			t.Errorf("HandlerConnect called with %+v", info)
+		}
+		if tt.err != nil {
+			if _, rerr := conn.ReadLine(); rerr == nil {
+				t.Errorf("connection not closed after %d", tt.code)
+			}
+		}
+		clientConn.Close()
+	}
+}
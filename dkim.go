@@ -0,0 +1,535 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDKIMHeaders are the header fields signed when DKIMOptions.Headers is empty.
+// Fields missing from a message are left out of the signature.
+var DefaultDKIMHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References", "Message-ID",
+	"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe", "List-Post", "List-Owner", "List-Archive",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMOptions describes how a message is signed (RFC 6376).
+// Messages are always signed with relaxed/relaxed canonicalization.
+type DKIMOptions struct {
+	Domain     string        // Signing domain (d=)
+	Selector   string        // Selector for the public key record (s=)
+	Key        crypto.Signer // *rsa.PrivateKey or ed25519.PrivateKey
+	Headers    []string      // Header fields to sign, DefaultDKIMHeaders if empty. From is always signed.
+	Oversign   []string      // Header fields signed once more than they occur, so none can be added later
+	Expiration time.Duration // Signature lifetime (x=), no expiry if zero
+}
+
+// DKIMLookup is called for every message accepted by the server and returns
+// the options to sign it with, or nil to deliver the message unsigned. The
+// session describes the client, e.g. the user it authenticated as.
+type DKIMLookup func(info *SessionInfo, from string) (*DKIMOptions, error)
+
+// LoadDKIMKey reads a PEM encoded RSA or Ed25519 private key from a file.
+func LoadDKIMKey(keyFile string) (crypto.Signer, error) {
+	keyPEMBlock, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDKIMKey(keyPEMBlock)
+}
+
+// ParseDKIMKey parses a PEM encoded RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key.
+func ParseDKIMKey(keyPEMBlock []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEMBlock)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("dkim: unsupported private key type %T", key)
+	}
+	return nil, fmt.Errorf("dkim: unsupported PEM block %q", block.Type)
+}
+
+// dkimFilter returns a message filter signing messages of the session with the
+// options returned by lookup.
+func dkimFilter(lookup DKIMLookup, info *SessionInfo) messageFilter {
+	return func(remoteAddr net.Addr, from string, to []string, msg *message) error {
+		opts, err := lookup(info, from)
+		if err != nil || opts == nil {
+			return err
+		}
+		prefix := "v=1; "
+		if opts.Expiration > 0 {
+			prefix += fmt.Sprintf("x=%d; ", time.Now().Add(opts.Expiration).Unix())
+		}
+		sig, err := opts.signature("DKIM-Signature", prefix, msg, time.Now())
+		if err != nil {
+			return err
+		}
+		msg.prepend(sig)
+		return nil
+	}
+}
+
+// algorithm returns the a= tag value for the key.
+func (opts *DKIMOptions) algorithm() (string, error) {
+	switch opts.Key.Public().(type) {
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case ed25519.PublicKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("dkim: unsupported key type %T", opts.Key.Public())
+}
+
+// signedHeaders returns the names listed in the h= tag for msg.
+func (opts *DKIMOptions) signedHeaders(msg *message) []string {
+	headers := opts.Headers
+	if len(headers) == 0 {
+		headers = DefaultDKIMHeaders
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	add := func(name string, oversign bool) {
+		key := strings.ToLower(name)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		n := len(msg.get(name))
+		if oversign {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			names = append(names, name)
+		}
+	}
+
+	// From must always be signed (RFC 6376 section 5.4).
+	add("From", containsFold(opts.Oversign, "From"))
+	for _, name := range headers {
+		add(name, containsFold(opts.Oversign, name))
+	}
+	for _, name := range opts.Oversign {
+		add(name, true)
+	}
+	return names
+}
+
+// signature returns a DKIM style signature field for msg. The prefix holds
+// any tags to list first, such as the version or ARC instance.
+func (opts *DKIMOptions) signature(name string, prefix string, msg *message, now time.Time) (headerField, error) {
+	algo, err := opts.algorithm()
+	if err != nil {
+		return headerField{}, err
+	}
+
+	bodyHash, err := canonicalBodyHash(msg.body.Reader(), true, -1)
+	if err != nil {
+		return headerField{}, err
+	}
+
+	names := opts.signedHeaders(msg)
+	eol := msg.eol + "\t"
+	tags := fmt.Sprintf("%sa=%s; c=relaxed/relaxed; d=%s; s=%s;%st=%d; h=%s;%sbh=%s;%sb=",
+		prefix, algo, opts.Domain, opts.Selector, eol, now.Unix(), strings.Join(names, ":"),
+		eol, base64.StdEncoding.EncodeToString(bodyHash), eol)
+
+	field := newHeaderField(name, tags, "")
+	b, err := signHeader(opts.Key, canonicalSignedHeaders(msg.header, names, true), field)
+	if err != nil {
+		return headerField{}, err
+	}
+	field.raw += foldBase64(b, msg.eol) + msg.eol
+	return field, nil
+}
+
+// signHeader computes the signature over the canonicalized signed fields
+// followed by the signature field itself, which must end with an empty b= tag.
+func signHeader(key crypto.Signer, signed string, sig headerField) (string, error) {
+	h := sha256.New()
+	io.WriteString(h, signed)
+	io.WriteString(h, strings.TrimSuffix(relaxedHeader(sig.raw), "\r\n"))
+	return signDigest(key, h.Sum(nil))
+}
+
+// signDigest signs a SHA-256 digest and returns the base64 encoded signature.
+func signDigest(key crypto.Signer, digest []byte) (string, error) {
+	var b []byte
+	var err error
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		// RFC 8463 signs the SHA-256 digest with PureEdDSA.
+		b, err = key.Sign(rand.Reader, digest, crypto.Hash(0))
+	} else {
+		b, err = key.Sign(rand.Reader, digest, crypto.SHA256)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// canonicalSignedHeaders returns the canonicalized fields named in h=, picking
+// instances from the bottom of the header up (RFC 6376 section 5.4.2).
+// Names without a remaining instance contribute nothing.
+func canonicalSignedHeaders(header []headerField, names []string, relaxed bool) string {
+	used := make(map[int]bool)
+	var b strings.Builder
+	for _, name := range names {
+		for i := len(header) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(header[i].name, strings.TrimSpace(name)) {
+				used[i] = true
+				if relaxed {
+					b.WriteString(relaxedHeader(header[i].raw))
+				} else {
+					b.WriteString(simpleHeader(header[i].raw))
+				}
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// relaxedHeader applies the relaxed header canonicalization algorithm
+// (RFC 6376 section 3.4.2) to a complete field.
+func relaxedHeader(raw string) string {
+	idx := strings.Index(raw, ":")
+	name := strings.ToLower(strings.TrimRight(raw[:idx], " \t"))
+	value := strings.Replace(raw[idx+1:], "\r\n", "", -1)
+	value = strings.Replace(value, "\n", "", -1)
+	return name + ":" + strings.Join(strings.FieldsFunc(value, isWSP), " ") + "\r\n"
+}
+
+// simpleHeader applies the simple header canonicalization algorithm
+// (RFC 6376 section 3.4.1), restoring the CRs stripped by DotReader.
+func simpleHeader(raw string) string {
+	return strings.Replace(strings.Replace(raw, "\r\n", "\n", -1), "\n", "\r\n", -1)
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// canonicalBodyHash returns the SHA-256 hash of r canonicalized with the
+// relaxed or simple body algorithm (RFC 6376 section 3.4), limited to the
+// first limit bytes of canonical output if limit is not negative.
+func canonicalBodyHash(r io.Reader, relaxed bool, limit int64) ([]byte, error) {
+	h := sha256.New()
+	var w io.Writer = h
+	if limit >= 0 {
+		w = &limitWriter{w: h, n: limit}
+	}
+	c := &bodyCanonicalizer{w: bufio.NewWriter(w), relaxed: relaxed}
+	if _, err := io.Copy(c, r); err != nil {
+		return nil, err
+	}
+	if err := c.Close(); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// bodyCanonicalizer canonicalizes a body as it is written. Both CRLF and bare
+// LF are accepted as line endings since DotReader strips the CR.
+type bodyCanonicalizer struct {
+	w       *bufio.Writer
+	relaxed bool
+	wsp     bool // whitespace seen since the last character written (relaxed only)
+	cr      bool // CR seen, not yet known to be part of a line ending
+	crlfs   int  // line endings not yet written, dropped if at the end of the body
+	written bool
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	for _, ch := range p {
+		if c.cr {
+			c.cr = false
+			if ch != '\n' {
+				c.char('\r')
+			}
+		}
+		switch {
+		case c.relaxed && (ch == ' ' || ch == '\t'):
+			c.wsp = true
+		case ch == '\r':
+			c.cr = true
+		case ch == '\n':
+			c.wsp = false
+			c.crlfs++
+		default:
+			c.char(ch)
+		}
+	}
+	return len(p), nil
+}
+
+func (c *bodyCanonicalizer) char(ch byte) {
+	for ; c.crlfs > 0; c.crlfs-- {
+		c.w.WriteString("\r\n")
+	}
+	if c.wsp {
+		c.w.WriteByte(' ')
+		c.wsp = false
+	}
+	c.w.WriteByte(ch)
+	c.written = true
+}
+
+// Close writes the final line ending. An empty body is empty in the relaxed
+// algorithm and a single line ending in the simple one.
+func (c *bodyCanonicalizer) Close() error {
+	if c.cr {
+		c.char('\r')
+	}
+	if c.written || !c.relaxed {
+		c.w.WriteString("\r\n")
+	}
+	return c.w.Flush()
+}
+
+// limitWriter discards everything written after the first n bytes.
+type limitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) <= l.n {
+		l.n -= int64(len(p))
+		return l.w.Write(p)
+	}
+	if l.n > 0 {
+		l.w.Write(p[:l.n])
+		l.n = 0
+	}
+	return len(p), nil
+}
+
+// foldBase64 splits a base64 tag value over several lines.
+func foldBase64(s string, eol string) string {
+	const width = 72
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString(eol + "\t")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTags parses a DKIM tag list (RFC 6376 section 3.2).
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		idx := strings.Index(spec, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("dkim: malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:idx])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("dkim: duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[idx+1:])
+	}
+	return tags, nil
+}
+
+// stripFWS removes all whitespace from a base64 tag value.
+func stripFWS(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// Errors of signatures that do not match the message.
+var (
+	errBodyHash  = errors.New("dkim: body hash did not verify")
+	errSignature = errors.New("dkim: signature did not verify")
+)
+
+var signatureValueRE = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// unsignedField returns sig with the value of its b= tag removed, as it was
+// when the signature was computed.
+func unsignedField(sig headerField) headerField {
+	idx := strings.Index(sig.raw, ":") + 1
+	sig.raw = sig.raw[:idx] + signatureValueRE.ReplaceAllString(sig.raw[idx:], "$1$2")
+	return sig
+}
+
+// verifySignature checks a DKIM-Signature or ARC-Message-Signature field
+// against msg, looking up the public key with lookupTXT.
+func verifySignature(msg *message, sig headerField, lookupTXT func(string) ([]string, error)) error {
+	tags, err := parseTags(sig.value())
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[name] == "" {
+			return fmt.Errorf("dkim: missing %s= tag", name)
+		}
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := tags["c"]; c != "" {
+		canon := strings.SplitN(c, "/", 2)
+		headerCanon = canon[0]
+		if len(canon) == 2 {
+			bodyCanon = canon[1]
+		}
+	}
+	for _, c := range []string{headerCanon, bodyCanon} {
+		if c != "simple" && c != "relaxed" {
+			return fmt.Errorf("dkim: unsupported canonicalization %q", c)
+		}
+	}
+
+	limit := int64(-1)
+	if l := tags["l"]; l != "" {
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			return fmt.Errorf("dkim: invalid l= tag %q", l)
+		}
+	}
+	bodyHash, err := canonicalBodyHash(msg.body.Reader(), bodyCanon == "relaxed", limit)
+	if err != nil {
+		return err
+	}
+	if base64.StdEncoding.EncodeToString(bodyHash) != stripFWS(tags["bh"]) {
+		return errBodyHash
+	}
+
+	// The signature field itself is never one of the signed fields.
+	var header []headerField
+	for _, f := range msg.header {
+		if f != sig {
+			header = append(header, f)
+		}
+	}
+
+	h := sha256.New()
+	io.WriteString(h, canonicalSignedHeaders(header, strings.Split(tags["h"], ":"), headerCanon == "relaxed"))
+	unsigned := unsignedField(sig)
+	if headerCanon == "relaxed" {
+		io.WriteString(h, strings.TrimSuffix(relaxedHeader(unsigned.raw), "\r\n"))
+	} else {
+		io.WriteString(h, strings.TrimSuffix(simpleHeader(unsigned.raw), "\r\n"))
+	}
+
+	pub, err := lookupKey(lookupTXT, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	return verifyDigest(pub, tags["a"], h.Sum(nil), tags["b"])
+}
+
+// verifyDigest checks a base64 encoded signature of digest made with algorithm algo.
+func verifyDigest(pub crypto.PublicKey, algo string, digest []byte, b string) error {
+	sig, err := base64.StdEncoding.DecodeString(stripFWS(b))
+	if err != nil {
+		return err
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if algo != "rsa-sha256" {
+			break
+		}
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if algo != "ed25519-sha256" {
+			break
+		}
+		if !ed25519.Verify(pub, digest, sig) {
+			return errSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("dkim: unsupported algorithm %q", algo)
+}
+
+// lookupKey fetches the public key for a selector and domain from DNS (RFC 6376 section 3.6.2).
+func lookupKey(lookupTXT func(string) ([]string, error), selector, domain string) (crypto.PublicKey, error) {
+	records, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, errors.New("dkim: no key record found")
+	}
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, err
+	}
+	if v := tags["v"]; v != "" && v != "DKIM1" {
+		return nil, fmt.Errorf("dkim: unsupported key record version %q", v)
+	}
+	p := stripFWS(tags["p"])
+	if p == "" {
+		return nil, errors.New("dkim: key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch tags["k"] {
+	case "", "rsa":
+		if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+			if pub, ok := pub.(*rsa.PublicKey); ok {
+				return pub, nil
+			}
+			return nil, errors.New("dkim: key record is not an RSA key")
+		}
+		return x509.ParsePKCS1PublicKey(der)
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, errors.New("dkim: invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(der), nil
+	}
+	return nil, fmt.Errorf("dkim: unsupported key type %q", tags["k"])
+}
@@ -0,0 +1,228 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// Examples from RFC 6376 section 3.4.5.
+func TestDKIMRelaxedCanonicalization(t *testing.T) {
+	header := relaxedHeader("A: X\r\n") + relaxedHeader("B : Y\t\r\n\tZ  \r\n")
+	if header != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("relaxedHeader() returned %q", header)
+	}
+
+	tests := []struct {
+		body string
+		want string
+	}{
+		{" C \r\nD \t E\r\n\r\n\r\n", " C\r\nD E\r\n"},
+		{" C \nD \t E\n\n\n", " C\r\nD E\r\n"},
+		{"no newline", "no newline\r\n"},
+		{"", ""},
+		{"\r\n\r\n", ""},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		w := &bodyCanonicalizer{w: bufio.NewWriter(&b), relaxed: true}
+		// Write one byte at a time to exercise state kept between writes.
+		for i := 0; i < len(tt.body); i++ {
+			w.Write([]byte{tt.body[i]})
+		}
+		w.Close()
+		if b.String() != tt.want {
+			t.Errorf("relaxed body of %q is %q, want %q", tt.body, b.String(), tt.want)
+		}
+	}
+
+	if header := simpleHeader("B : Y\t\n\tZ  \n"); header != "B : Y\t\r\n\tZ  \r\n" {
+		t.Errorf("simpleHeader() returned %q", header)
+	}
+	simple := []struct {
+		body string
+		want string
+	}{
+		{" C \nD \t E\n\n\n", " C \r\nD \t E\r\n"},
+		{"", "\r\n"},
+	}
+	for _, tt := range simple {
+		var b strings.Builder
+		w := &bodyCanonicalizer{w: bufio.NewWriter(&b)}
+		w.Write([]byte(tt.body))
+		w.Close()
+		if b.String() != tt.want {
+			t.Errorf("simple body of %q is %q, want %q", tt.body, b.String(), tt.want)
+		}
+	}
+}
+
+func TestParseDKIMKey(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(ed25519.PrivateKey); !ok {
+		t.Errorf("ParseDKIMKey() returned %T, want ed25519.PrivateKey", key)
+	}
+
+	rsaKey := cert.PrivateKey.(*rsa.PrivateKey)
+	key, err = ParseDKIMKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		t.Errorf("ParseDKIMKey() returned %T, want *rsa.PrivateKey", key)
+	}
+
+	if _, err = ParseDKIMKey([]byte("not a key")); err == nil {
+		t.Error("ParseDKIMKey() accepted invalid input")
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []crypto.Signer{cert.PrivateKey.(*rsa.PrivateKey), edKey}
+
+	for _, key := range keys {
+		var received string
+		server := &Server{
+			DKIM: func(info *SessionInfo, from string) (*DKIMOptions, error) {
+				if !strings.HasSuffix(from, "@example.com") {
+					return nil, nil
+				}
+				return &DKIMOptions{Domain: "example.com", Selector: "test", Key: key, Oversign: []string{"Subject"}}, nil
+			},
+			Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+				b, err := ioutil.ReadAll(body)
+				received = string(b)
+				return err
+			},
+		}
+
+		conn := newConn(t, server)
+		cmdCode(t, conn, "EHLO host.example.com", 250)
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+		cmdCode(t, conn, "DATA", 354)
+		cmdCode(t, conn, "From: sender@example.com\r\nSubject:  Hello\r\n\tworld\r\nTo: recipient@example.com\r\n\r\nTest  message.\r\n\r\n.", 250)
+
+		if !strings.HasPrefix(received, "DKIM-Signature: ") {
+			t.Fatalf("message was not signed: %q", received)
+		}
+		if !strings.HasSuffix(received, "\nTest  message.\n\n") {
+			t.Errorf("message body was modified: %q", received)
+		}
+		verifyTestSignature(t, received, key.Public())
+
+		// Messages the lookup declines are delivered unsigned.
+		cmdCode(t, conn, "MAIL FROM:<sender@example.org>", 250)
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+		cmdCode(t, conn, "DATA", 354)
+		cmdCode(t, conn, "From: sender@example.org\r\n\r\nTest message.\r\n.", 250)
+		if strings.Contains(received, "DKIM-Signature") {
+			t.Errorf("message was signed: %q", received)
+		}
+
+		cmdCode(t, conn, "QUIT", 221)
+		conn.Close()
+	}
+}
+
+// Check the signature of a message against the public key of the signer.
+func verifyTestSignature(t *testing.T, raw string, pub crypto.PublicKey) {
+	msg, err := readMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := parseTags(msg.header[0].value())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags["h"] != "From:Subject:Subject:To" {
+		t.Errorf("signed headers are %q", tags["h"])
+	}
+
+	lookupTXT := func(name string) ([]string, error) {
+		if name != "test._domainkey.example.com" {
+			t.Errorf("looked up key %q", name)
+		}
+		if pub, ok := pub.(ed25519.PublicKey); ok {
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		}
+		der, _ := x509.MarshalPKIXPublicKey(pub)
+		return []string{"v=DKIM1; p=" + base64.StdEncoding.EncodeToString(der)}, nil
+	}
+	if err = verifySignature(msg, msg.header[0], lookupTXT); err != nil {
+		t.Errorf("signature verification failed: %v", err)
+	}
+
+	// Any change to a signed field breaks the signature.
+	msg.header[2].raw = "Subject: Goodbye\r\n"
+	if err = verifySignature(msg, msg.header[0], lookupTXT); err == nil {
+		t.Error("signature of modified message verified")
+	}
+}
+
+// Example from RFC 8463 appendix A.
+func TestDKIMTestVector(t *testing.T) {
+	raw := "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+	msg, err := readMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lookupTXT := func(name string) ([]string, error) {
+		if name != "brisbane._domainkey.football.example.com" {
+			t.Errorf("looked up key %q", name)
+		}
+		return []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}, nil
+	}
+	if err = verifySignature(msg, msg.header[0], lookupTXT); err != nil {
+		t.Errorf("signature verification failed: %v", err)
+	}
+
+	// Ed25519 signatures are deterministic, so signing gives the same value.
+	seed, _ := base64.StdEncoding.DecodeString("nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A=")
+	tags, _ := parseTags(msg.header[0].value())
+	names := strings.Split(tags["h"], ":")
+	b, err := signHeader(ed25519.NewKeyFromSeed(seed), canonicalSignedHeaders(msg.header[1:], names, true), unsignedField(msg.header[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b != stripFWS(tags["b"]) {
+		t.Errorf("signature is %q, want %q", b, stripFWS(tags["b"]))
+	}
+}
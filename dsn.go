@@ -0,0 +1,199 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DSN is a delivery status notification (RFC 3464): a multipart/report
+// message telling the sender of a message what became of it. Send it with a
+// null reverse-path (MAIL FROM:<>), and never in response to a message that
+// itself had a null reverse-path.
+type DSN struct {
+	ReportingMTA string    // Hostname of the MTA issuing the report
+	From         string    // Reverse-path of the original message, the report's recipient
+	EnvelopeID   string    // ENVID given with the original MAIL command, decoded with DecodeXtext
+	Return       string    // RET given with the original MAIL command: "FULL" returns the whole message, otherwise only its header
+	ArrivalDate  time.Time // When the original message was received, omitted if zero
+	Recipients   []DSNRecipient
+	Message      []byte // Original message, with LF or CRLF line endings
+}
+
+// Return a DSN for a message, honoring the RET and ENVID parameters given
+// with its MAIL command. An ENVID that is not valid xtext is left out.
+func newDSN(reportingMTA, from string, params map[string]string, msg []byte) *DSN {
+	dsn := &DSN{ReportingMTA: reportingMTA, From: from, Return: params["RET"], Message: msg}
+	if envid, err := DecodeXtext(params["ENVID"]); err == nil {
+		dsn.EnvelopeID = envid
+	}
+	return dsn
+}
+
+// DecodeXtext decodes a value in the xtext encoding of ESMTP parameters such
+// as ENVID and ORCPT (RFC 3461 section 4), where "+" followed by two upper
+// case hexadecimal digits stands for that octet.
+func DecodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '+':
+			if i+2 >= len(s) || strings.ToUpper(s[i+1:i+3]) != s[i+1:i+3] {
+				return "", fmt.Errorf("invalid xtext %q", s)
+			}
+			n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid xtext %q", s)
+			}
+			b.WriteByte(byte(n))
+			i += 2
+		case c < '!' || c > '~' || c == '=':
+			return "", fmt.Errorf("invalid xtext %q", s)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// DSNRecipient is the delivery status of one recipient.
+type DSNRecipient struct {
+	FinalRecipient    string // Recipient address
+	OriginalRecipient string // ORCPT given with the original RCPT command, if any
+	Action            string // "failed", "delayed", "delivered", "relayed" or "expanded"
+	Status            string // Enhanced status code, e.g. "5.1.1"
+	RemoteMTA         string // Host that reported the status, if any
+	DiagnosticCode    string // Reply from RemoteMTA, e.g. "550 5.1.1 No such user"
+}
+
+// Bytes returns the report, with LF line endings.
+func (d *DSN) Bytes() []byte {
+	reportingMTA := d.ReportingMTA
+	if reportingMTA == "" {
+		reportingMTA = "localhost"
+	}
+	boundary := newSessionID() + "/" + reportingMTA
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\n", reportingMTA)
+	fmt.Fprintf(&b, "To: <%s>\n", d.From)
+	fmt.Fprintf(&b, "Subject: %s\n", d.subject())
+	fmt.Fprintf(&b, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\n", newSessionID(), reportingMTA)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\n\tboundary=\"%s\"\n\n", boundary)
+	fmt.Fprintf(&b, "This is a MIME-encapsulated message.\n\n")
+
+	// Human readable part.
+	fmt.Fprintf(&b, "--%s\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=us-ascii\nContent-Description: Notification\n\n")
+	fmt.Fprintf(&b, "This is the mail system at host %s.\n", reportingMTA)
+	for _, action := range []string{"failed", "delayed", "delivered", "relayed", "expanded"} {
+		var lines []string
+		for _, rcpt := range d.Recipients {
+			if rcpt.Action != action {
+				continue
+			}
+			line := "<" + rcpt.FinalRecipient + ">"
+			if rcpt.DiagnosticCode != "" && rcpt.RemoteMTA != "" {
+				line += ": host " + rcpt.RemoteMTA + " said: " + rcpt.DiagnosticCode
+			} else if rcpt.DiagnosticCode != "" {
+				line += ": " + rcpt.DiagnosticCode
+			}
+			lines = append(lines, line)
+		}
+		if len(lines) > 0 {
+			fmt.Fprintf(&b, "\n%s\n\n    %s\n", dsnActionText[action], strings.Join(lines, "\n    "))
+		}
+	}
+	b.WriteString("\n")
+
+	// Machine readable part.
+	fmt.Fprintf(&b, "--%s\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\nContent-Description: Delivery report\n\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\n", reportingMTA)
+	if d.EnvelopeID != "" {
+		fmt.Fprintf(&b, "Original-Envelope-Id: %s\n", d.EnvelopeID)
+	}
+	if !d.ArrivalDate.IsZero() {
+		fmt.Fprintf(&b, "Arrival-Date: %s\n", d.ArrivalDate.Format(time.RFC1123Z))
+	}
+	for _, rcpt := range d.Recipients {
+		b.WriteString("\n")
+		if rcpt.OriginalRecipient != "" {
+			fmt.Fprintf(&b, "Original-Recipient: rfc822; %s\n", rcpt.OriginalRecipient)
+		}
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\n", rcpt.FinalRecipient)
+		fmt.Fprintf(&b, "Action: %s\n", rcpt.Action)
+		fmt.Fprintf(&b, "Status: %s\n", rcpt.Status)
+		if rcpt.RemoteMTA != "" {
+			fmt.Fprintf(&b, "Remote-MTA: dns; %s\n", rcpt.RemoteMTA)
+		}
+		if rcpt.DiagnosticCode != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\n", rcpt.DiagnosticCode)
+		}
+	}
+	b.WriteString("\n")
+
+	// The original message, or its header.
+	msg := bytes.Replace(d.Message, []byte("\r\n"), []byte("\n"), -1)
+	fmt.Fprintf(&b, "--%s\n", boundary)
+	if strings.EqualFold(d.Return, "FULL") {
+		fmt.Fprintf(&b, "Content-Type: message/rfc822\nContent-Description: Undelivered Message\n\n")
+	} else {
+		fmt.Fprintf(&b, "Content-Type: text/rfc822-headers\nContent-Description: Undelivered Message Headers\n\n")
+		if bytes.HasPrefix(msg, []byte("\n")) {
+			msg = nil
+		} else if i := bytes.Index(msg, []byte("\n\n")); i >= 0 {
+			msg = msg[:i+1]
+		}
+	}
+	b.Write(msg)
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "\n--%s--\n", boundary)
+	return b.Bytes()
+}
+
+var dsnActionText = map[string]string{
+	"failed":    "I'm sorry to have to inform you that your message could not\nbe delivered to one or more recipients.",
+	"delayed":   "Your message could not be delivered yet to the recipients below.\nDelivery will be retried.",
+	"delivered": "Your message was successfully delivered to the recipients below.",
+	"relayed":   "Your message was relayed to the recipients below, whose\ndestination does not issue delivery notifications.",
+	"expanded":  "Your message was delivered to the mailing lists or aliases below,\nwhich were expanded to further recipients.",
+}
+
+// Return the subject of the report from the most significant action.
+func (d *DSN) subject() string {
+	actions := make(map[string]bool)
+	for _, rcpt := range d.Recipients {
+		actions[rcpt.Action] = true
+	}
+	switch {
+	case actions["failed"]:
+		return "Undelivered Mail Returned to Sender"
+	case actions["delayed"]:
+		return "Delayed Mail (still being retried)"
+	}
+	return "Successful Mail Delivery Report"
+}
+
+// DSNRecipient returns the status of the recipient for a DSN.
+func (f RelayFailure) DSNRecipient() DSNRecipient {
+	rcpt := DSNRecipient{
+		FinalRecipient: f.Rcpt,
+		Action:         "failed",
+		Status:         f.Err.EnhancedCode,
+		RemoteMTA:      f.RemoteMTA,
+	}
+	if rcpt.Status == "" {
+		rcpt.Status = strconv.Itoa(f.Err.Code/100) + ".0.0"
+	}
+	rcpt.DiagnosticCode = f.Err.Error()
+	return rcpt
+}
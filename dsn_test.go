@@ -0,0 +1,107 @@
+package smtpd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestDSN(t *testing.T) {
+	failure := RelayFailure{
+		Rcpt:      "alice@example.com",
+		RemoteMTA: "mx.example.com",
+		Err:       &Error{Code: 550, EnhancedCode: "5.1.1", Message: "No such user"},
+	}
+	tests := []struct {
+		ret      string
+		partType string
+		want     string
+	}{
+		{"FULL", "message/rfc822", "Subject: Test\n\nHello.\n"},
+		{"HDRS", "text/rfc822-headers", "Subject: Test\n"},
+		{"", "text/rfc822-headers", "Subject: Test\n"},
+	}
+	for _, tt := range tests {
+		dsn := &DSN{
+			ReportingMTA: "relay.example.com",
+			From:         "sender@example.net",
+			EnvelopeID:   "QQ314159",
+			Return:       tt.ret,
+			Recipients: []DSNRecipient{
+				failure.DSNRecipient(),
+				{FinalRecipient: "bob@example.com", Action: "delayed", Status: "4.4.1", DiagnosticCode: "451 4.4.1 Connection refused"},
+			},
+			Message: []byte("Subject: Test\r\n\r\nHello.\r\n"),
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(dsn.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Header.Get("To") != "<sender@example.net>" || msg.Header.Get("Subject") != "Undelivered Mail Returned to Sender" {
+			t.Errorf("header is %v", msg.Header)
+		}
+		mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if err != nil || mediaType != "multipart/report" || params["report-type"] != "delivery-status" {
+			t.Fatalf("content type is %q, %v", msg.Header.Get("Content-Type"), err)
+		}
+
+		var types, bodies []string
+		r := multipart.NewReader(msg.Body, params["boundary"])
+		for {
+			part, err := r.NextPart()
+			if err != nil {
+				break
+			}
+			b, _ := ioutil.ReadAll(part)
+			types = append(types, part.Header.Get("Content-Type"))
+			bodies = append(bodies, string(b))
+		}
+		if len(types) != 3 || !strings.HasPrefix(types[0], "text/plain") || types[1] != "message/delivery-status" || types[2] != tt.partType {
+			t.Fatalf("RET=%s: parts are %q", tt.ret, types)
+		}
+		if !strings.Contains(bodies[0], "<alice@example.com>: host mx.example.com said: 550 5.1.1 No such user") {
+			t.Errorf("notification is %q", bodies[0])
+		}
+		status := "Reporting-MTA: dns; relay.example.com\nOriginal-Envelope-Id: QQ314159\n\n" +
+			"Final-Recipient: rfc822; alice@example.com\nAction: failed\nStatus: 5.1.1\n" +
+			"Remote-MTA: dns; mx.example.com\nDiagnostic-Code: smtp; 550 5.1.1 No such user\n\n" +
+			"Final-Recipient: rfc822; bob@example.com\nAction: delayed\nStatus: 4.4.1\n" +
+			"Diagnostic-Code: smtp; 451 4.4.1 Connection refused\n"
+		if bodies[1] != status {
+			t.Errorf("delivery status is %q, want %q", bodies[1], status)
+		}
+		if bodies[2] != tt.want {
+			t.Errorf("RET=%s: returned %q, want %q", tt.ret, bodies[2], tt.want)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"", "", true},
+		{"QQ314159", "QQ314159", true},
+		{"a+2Bb+3Dc", "a+b=c", true},
+		{"+2B+2B", "++", true},
+		{"a+2b", "", false},
+		{"a+2", "", false},
+		{"a+", "", false},
+		{"a+ZZ", "", false},
+		{"a=b", "", false},
+		{"a b", "", false},
+		{"caf\xc3\xa9", "", false},
+	}
+	for _, tt := range tests {
+		got, err := DecodeXtext(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("DecodeXtext(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// EML writes each message to its own .eml file in a directory, with its
+// envelope in a JSON file of the same name ending in .json. Its
+// DeliverContext method is a HandlerContext, and Deliver a Handler recording
+// less of the envelope.
+//
+// Both files are written under names starting with "." and renamed once
+// complete, the .json file first, so a reader only sees complete messages
+// and finds the envelope of each. They are removed if the message cannot be
+// written in full, e.g. because it exceeds Server.MaxSize.
+type EML struct {
+	Dir  string // Directory the files are written to, created if missing
+	Sync bool   // fsync the files and directory before accepting the message
+}
+
+// Envelope is the content of the JSON file written with each message by EML.
+type Envelope struct {
+	From       string       `json:"from"`
+	To         []string     `json:"to"`
+	RemoteAddr string       `json:"remote_addr"`
+	Helo       string       `json:"helo,omitempty"`
+	TLS        *EnvelopeTLS `json:"tls,omitempty"`
+	Received   time.Time    `json:"received"`
+	Size       int64        `json:"size"`
+}
+
+// EnvelopeTLS describes the TLS connection a message was received on.
+type EnvelopeTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+}
+
+// Deliver writes the message and its envelope, without the HELO name and TLS
+// details which a Handler is not given.
+func (e *EML) Deliver(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	return e.DeliverContext(context.Background(), remoteAddr, from, to, body)
+}
+
+// DeliverContext writes the message and its envelope, including the session
+// details from SessionFromContext(ctx).
+func (e *EML) DeliverContext(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	env := &Envelope{From: from, To: to, RemoteAddr: remoteAddr.String(), Received: time.Now().UTC()}
+	if info := SessionFromContext(ctx); info != nil {
+		env.Helo = info.Helo
+		if info.TLS != nil {
+			env.TLS = &EnvelopeTLS{
+				Version:     tlsVersionName(info.TLS.Version),
+				CipherSuite: tls.CipherSuiteName(info.TLS.CipherSuite),
+				ServerName:  info.TLS.ServerName,
+			}
+		}
+	}
+
+	if err := os.MkdirAll(e.Dir, 0700); err != nil {
+		return err
+	}
+	name := filepath.Join(e.Dir, maildirName(0))
+	tmp := filepath.Join(e.Dir, "."+filepath.Base(name))
+	defer os.Remove(tmp + ".eml")
+	defer os.Remove(tmp + ".json")
+
+	var err error
+	if env.Size, err = writeFile(tmp+".eml", "", body, e.Sync); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := writeFile(tmp+".json", "", bytes.NewReader(append(b, '\n')), e.Sync); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp+".json", name+".json"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp+".eml", name+".eml"); err != nil {
+		os.Remove(name + ".json")
+		return err
+	}
+	return syncDir(e.Dir, e.Sync)
+}
@@ -0,0 +1,48 @@
+package smtpd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEML(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &EML{Dir: filepath.Join(dir, "messages"), Sync: true}
+	server := &Server{HandlerContext: e.DeliverContext, MaxSize: 100}
+	sendMessage(t, server, "Subject: Test\r\n\r\nHello.", 250)
+	sendMessage(t, server, "Subject: Big\r\n\r\n"+strings.Repeat("Too long.\r\n", 20), 552)
+
+	files, err := ioutil.ReadDir(e.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("wrote %d files, want a message and its envelope", len(files))
+	}
+	name := filepath.Join(e.Dir, strings.TrimSuffix(files[0].Name(), ".eml"))
+	if b, err := ioutil.ReadFile(name + ".eml"); err != nil || string(b) != "Subject: Test\n\nHello.\n" {
+		t.Errorf("message is %q, %v", b, err)
+	}
+
+	b, err := ioutil.ReadFile(name + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.From != "sender@example.com" || len(env.To) != 1 || env.To[0] != "recipient@example.com" ||
+		env.RemoteAddr == "" || env.Helo != "host.example.com" || env.TLS != nil || env.Received.IsZero() || env.Size != 22 {
+		t.Errorf("envelope is %s", b)
+	}
+}
@@ -0,0 +1,115 @@
+//go:build go1.18
+// +build go1.18
+
+package smtpd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// In-memory connection reading the client's bytes from r and collecting the
+// server's replies.
+type fuzzConn struct {
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *fuzzConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *fuzzConn) Write(b []byte) (int, error)        { return c.w.Write(b) }
+func (c *fuzzConn) Close() error                       { return nil }
+func (c *fuzzConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 25} }
+func (c *fuzzConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2525} }
+func (c *fuzzConn) SetDeadline(t time.Time) error      { return nil }
+func (c *fuzzConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fuzzConn) SetWriteDeadline(t time.Time) error { return nil }
+
+var fuzzReplyRE = regexp.MustCompile(`^[2-5][0-9][0-9][ -]`)
+
+// Run a session reading input as the client's side of the conversation,
+// returning the server's replies.
+func fuzzSession(t *testing.T, input []byte) []string {
+	server := &Server{
+		Hostname:  "mx.example.com",
+		MaxSize:   1000,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			_, err := io.Copy(ioutil.Discard, body)
+			return err
+		},
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			return !strings.HasPrefix(to, "reject")
+		},
+	}
+	conn := &fuzzConn{r: bytes.NewReader(input)}
+	server.newSession(conn).serve()
+
+	output := strings.TrimSuffix(conn.w.String(), "\r\n")
+	lines := strings.Split(output, "\r\n")
+	for _, line := range lines {
+		if !fuzzReplyRE.MatchString(line) || len(line) > 510 {
+			t.Fatalf("malformed reply %q to %q", line, input)
+		}
+		// Anything after this is part of the TLS handshake.
+		if strings.HasPrefix(line, "220 2.0.0 ") {
+			break
+		}
+	}
+	return lines
+}
+
+func FuzzSession(f *testing.F) {
+	for _, seed := range []string{
+		"EHLO host.example.com\r\nMAIL FROM:<sender@example.com>\r\nRCPT TO:<recipient@example.com>\r\nDATA\r\nSubject: Test\r\n\r\n..Hello\r\n.\r\nQUIT\r\n",
+		"HELO host\r\nMAIL FROM:<> SIZE=100\r\nRCPT TO:<reject@example.com>\r\nRCPT TO:<a@b>\r\nRSET\r\nNOOP\r\nQUIT\r\n",
+		"EHLO host\r\nSTARTTLS\r\n\x16\x03\x01\x00\x05hello",
+		"ehlo host\nmail from:<a@b> size=99999\nrcpt to:<c@d>\ndata\n",
+		"MAIL FROM:<a@b>\r\nRCPT TO:<" + strings.Repeat("x", 70) + "@example.com>\r\n",
+		"\x00\xff\xfe VRFY\r\n\r\n \r\nAUTH PLAIN abc\r\n",
+		strings.Repeat("A", 600) + "\r\nQUIT\r\n",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		fuzzSession(t, input)
+	})
+}
+
+func TestSessionHardening(t *testing.T) {
+	longLocal := strings.Repeat("l", 65) + "@example.com"
+	longDomain := "user@" + strings.Repeat("d", 250) + ".com"
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{strings.Repeat("A", 600) + "\r\n", "500 5.5.6 "},
+		{"NOOP " + strings.Repeat("x", 506) + "\r\n", "500 5.5.6 "},
+		{"NOOP " + strings.Repeat("x", 505) + "\r\n", "250 2.0.0 "},
+		{"NO\x00OP\r\n", "500 5.5.2 "},
+		{"ſTARTTLS\r\n", "500 5.5.2 "},
+		{"NÖOP\r\n", "500 5.5.2 "},
+		{"MAIL FROM:<" + longLocal + ">\r\n", "501 5.1.7 "},
+		{"MAIL FROM:<" + longDomain + ">\r\n", "501 5.1.7 "},
+		{"MAIL FROM:<a@example.com>\r\nRCPT TO:<" + longLocal + ">\r\n", "501 5.1.3 "},
+		{"MAIL FROM:<a@example.com>\r\nRCPT TO:<" + longDomain + ">\r\n", "501 5.1.3 "},
+	}
+	for _, tt := range tests {
+		lines := fuzzSession(t, []byte(tt.input+"QUIT\r\n"))
+		if len(lines) < 3 || !strings.HasPrefix(lines[len(lines)-2], tt.want) {
+			t.Errorf("%.40q replied %q, want %q", tt.input, lines, tt.want)
+		}
+	}
+
+	// The session continues after a long line.
+	lines := fuzzSession(t, []byte(strings.Repeat("A", 5000)+"\r\nNOOP\r\nQUIT\r\n"))
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "250 ") {
+		t.Errorf("long line followed by NOOP replied %q", lines)
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/jawr/smtpd
 
-go 1.13
+go 1.14
@@ -0,0 +1,95 @@
+package smtpd
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// HeaderPolicy configures the validation of the header of accepted messages
+// (RFC 5322 section 3.6). A message is rejected with 550 5.6.0 and the reason
+// if it does not have exactly one From and one Date field and a Message-ID
+// field, if a field occurring at most once occurs more often, if an address
+// field or the Date field cannot be parsed, or if a header line is too long.
+type HeaderPolicy struct {
+	MaxLineLength int // Maximum header line length in octets, excluding CRLF, defaults to 998
+
+	// Submission reports whether a message comes from a submission client
+	// (RFC 6409), e.g. one that authenticated. A missing Message-ID or Date
+	// field is then added instead of rejecting the message (RFC 6409 section 8).
+	Submission func(info *SessionInfo) bool
+}
+
+// Header fields that may occur at most once (RFC 5322 section 3.6).
+var singletonFields = []string{"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Message-ID", "In-Reply-To", "References", "Subject"}
+
+// Header fields holding address lists.
+var addressFields = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Resent-From", "Resent-Sender", "Resent-To", "Resent-Cc", "Resent-Bcc"}
+
+// headerError returns the error rejecting a message with an invalid header.
+func headerError(reason string) *Error {
+	return &Error{Code: 550, EnhancedCode: "5.6.0", Message: reason}
+}
+
+// headerFilter returns a message filter applying the policy to a message of
+// the session described by info. Message-IDs added for submission clients use
+// hostname as their domain.
+func headerFilter(policy *HeaderPolicy, hostname string, info *SessionInfo) messageFilter {
+	return func(remoteAddr net.Addr, from string, to []string, msg *message) error {
+		maxLineLength := policy.MaxLineLength
+		if maxLineLength <= 0 {
+			maxLineLength = maxTextLineLength - 2
+		}
+		for _, f := range msg.header {
+			for _, line := range strings.Split(strings.TrimRight(f.raw, "\r\n"), "\n") {
+				if len(strings.TrimSuffix(line, "\r")) > maxLineLength {
+					return headerError("Header line too long in " + f.name + " field")
+				}
+			}
+		}
+
+		for _, name := range singletonFields {
+			if len(msg.get(name)) > 1 {
+				return headerError("Multiple " + name + " header fields")
+			}
+		}
+
+		for _, name := range addressFields {
+			for _, f := range msg.get(name) {
+				value := f.value()
+				if value == "" && (strings.EqualFold(name, "Bcc") || strings.EqualFold(name, "Resent-Bcc")) {
+					continue
+				}
+				addrs, err := mail.ParseAddressList(value)
+				if err != nil {
+					return headerError("Invalid " + name + " header field")
+				}
+				// RFC 5322 section 3.6.2: with several authors, Sender names the one who sent the message.
+				if strings.EqualFold(name, "From") && len(addrs) > 1 && len(msg.get("Sender")) == 0 {
+					return headerError("Sender header field required with multiple From addresses")
+				}
+			}
+		}
+		if len(msg.get("From")) == 0 {
+			return headerError("Missing From header field")
+		}
+
+		submission := policy.Submission != nil && policy.Submission(info)
+		var added []headerField
+		if dates := msg.get("Date"); len(dates) == 0 && submission {
+			added = append(added, newHeaderField("Date", time.Now().Format(time.RFC1123Z), msg.eol))
+		} else if len(dates) == 0 {
+			return headerError("Missing Date header field")
+		} else if _, err := mail.ParseDate(dates[0].value()); err != nil {
+			return headerError("Invalid Date header field")
+		}
+		if len(msg.get("Message-ID")) == 0 && submission {
+			added = append(added, newHeaderField("Message-ID", "<"+newSessionID()+"."+newSessionID()+"@"+hostname+">", msg.eol))
+		} else if len(msg.get("Message-ID")) == 0 {
+			return headerError("Missing Message-ID header field")
+		}
+		msg.header = append(msg.header, added...)
+		return nil
+	}
+}
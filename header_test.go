@@ -0,0 +1,70 @@
+package smtpd
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHeaderPolicy(t *testing.T) {
+	var received string
+	submission := false
+	server := &Server{
+		Hostname: "mail.example.com",
+		HeaderPolicy: &HeaderPolicy{
+			Submission: func(info *SessionInfo) bool { return submission && info.Helo == "host.example.com" },
+		},
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			received = string(b)
+			return err
+		},
+	}
+
+	const valid = "From: Alice <alice@example.com>\r\nTo: bob@example.com\r\nDate: Mon, 2 Jan 2006 15:04:05 -0700\r\nMessage-ID: <1@example.com>\r\n"
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{valid, ""},
+		{valid + "Bcc:\r\n", ""},
+		{valid + "Subject: One\r\nSubject: Two\r\n", "Multiple Subject header fields"},
+		{valid + "from: carol@example.com\r\n", "Multiple From header fields"},
+		{strings.Replace(valid, "alice@example.com", "alice@", 1), "Invalid From header field"},
+		{strings.Replace(valid, "Alice <alice@example.com>", "alice@example.com, carol@example.com", 1), "Sender header field required with multiple From addresses"},
+		{strings.Replace(valid, "Mon, 2 Jan 2006", "yesterday", 1), "Invalid Date header field"},
+		{valid + "X-Long: " + strings.Repeat("x", 991) + "\r\n", "Header line too long in X-Long field"},
+		{valid + "X-Folded: " + strings.Repeat("x", 900) + "\r\n " + strings.Repeat("x", 900) + "\r\n", ""},
+		{strings.Replace(valid, "From: Alice <alice@example.com>\r\n", "", 1), "Missing From header field"},
+		{strings.Replace(valid, "Date: Mon, 2 Jan 2006 15:04:05 -0700\r\n", "", 1), "Missing Date header field"},
+		{strings.Replace(valid, "Message-ID: <1@example.com>\r\n", "", 1), "Missing Message-ID header field"},
+	}
+	for _, tt := range tests {
+		received = ""
+		conn := newConn(t, server)
+		cmdCode(t, conn, "EHLO host.example.com", 250)
+		cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+		cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+		cmdCode(t, conn, "DATA", 354)
+		if tt.want == "" {
+			cmdCode(t, conn, tt.header+"\r\nHello.\r\n.", 250)
+			if want := strings.Replace(tt.header+"\r\nHello.\r\n", "\r\n", "\n", -1); received != want {
+				t.Errorf("received %q", received)
+			}
+		} else if msg := cmdCode(t, conn, tt.header+"\r\nHello.\r\n.", 550); msg != "5.6.0 "+tt.want {
+			t.Errorf("rejected with %q, want %q", msg, tt.want)
+		}
+		cmdCode(t, conn, "QUIT", 221)
+		conn.Close()
+	}
+
+	// Submission clients get the missing fields added.
+	submission = true
+	sendMessage(t, server, "From: alice@example.com\r\n\r\nHello.\r\n", 250)
+	if !strings.Contains(received, "\nDate: ") || !strings.Contains(received, "@mail.example.com>\n\nHello.") {
+		t.Errorf("received %q", received)
+	}
+	sendMessage(t, server, "From: alice@example.com\r\nDate: today\r\n\r\nHello.\r\n", 550)
+}
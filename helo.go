@@ -0,0 +1,153 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+)
+
+// HandlerHelo function called on HELO and EHLO after the HeloPolicy checks,
+// with the name given by the client as info.Helo and the checks it failed
+// with HeloScore as info.HeloFailures. Return nil to accept it; an *Error is
+// sent as the reply, other errors are replied to with 451 4.3.0.
+type HandlerHelo func(info *SessionInfo) error
+
+// HeloAction is what a HeloPolicy check does with a name failing it.
+type HeloAction int
+
+// Actions of HeloPolicy checks.
+const (
+	HeloIgnore HeloAction = iota // The check is not made
+	HeloReject                   // The command is rejected
+	HeloScore                    // The command is accepted, and the failure logged and listed in SessionInfo.HeloFailures
+)
+
+// HeloPolicy configures the checks made of the name a client gives with HELO
+// or EHLO. Each check names the action taken when it fails.
+type HeloPolicy struct {
+	Empty      HeloAction                          // Fail names that are empty ("empty"), replying 501 5.5.4
+	BareIP     HeloAction                          // Fail IP addresses not enclosed in brackets as address literals ("bare_ip"), replying 501 5.5.2
+	FQDN       HeloAction                          // Fail names that are neither fully qualified domain names nor address literals ("not_fqdn"), replying 504 5.5.2
+	Own        HeloAction                          // Fail the server's Hostname and address literals of its own IP address ("own_name"), replying 550 5.7.1
+	Resolve    HeloAction                          // Fail domain names that do not resolve to an address ("unresolvable"), replying 450 4.7.1
+	LookupHost func(host string) ([]string, error) // Address lookup for Resolve, defaults to net.LookupHost
+}
+
+// A HELO check: its name, whether the client's name passes it, and the reply if not.
+type heloCheck struct {
+	name   string
+	action HeloAction
+	passes func(s *session, helo string) bool
+	reply  *Error
+}
+
+// Return the checks of the policy in the order they are made.
+func (p *HeloPolicy) checks() []heloCheck {
+	return []heloCheck{
+		{"empty", p.Empty, func(s *session, helo string) bool {
+			return helo != ""
+		}, &Error{Code: 501, EnhancedCode: "5.5.4", Message: "Syntax error in parameters or arguments (domain required)"}},
+		{"bare_ip", p.BareIP, func(s *session, helo string) bool {
+			return net.ParseIP(helo) == nil
+		}, &Error{Code: 501, EnhancedCode: "5.5.2", Message: "Helo command rejected: address literals must be enclosed in brackets"}},
+		{"not_fqdn", p.FQDN, func(s *session, helo string) bool {
+			return helo == "" || addressLiteral(helo) != nil || isFQDN(helo)
+		}, &Error{Code: 504, EnhancedCode: "5.5.2", Message: "Helo command rejected: need fully-qualified hostname"}},
+		{"own_name", p.Own, func(s *session, helo string) bool {
+			if strings.EqualFold(strings.TrimSuffix(helo, "."), strings.TrimSuffix(s.srv.Hostname, ".")) {
+				return false
+			}
+			local, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+			ip := addressLiteral(helo)
+			return ip == nil || !ip.Equal(net.ParseIP(local))
+		}, &Error{Code: 550, EnhancedCode: "5.7.1", Message: "Helo command rejected: you are not me"}},
+		{"unresolvable", p.Resolve, func(s *session, helo string) bool {
+			if helo == "" || addressLiteral(helo) != nil || net.ParseIP(helo) != nil {
+				return true
+			}
+			lookupHost := p.LookupHost
+			if lookupHost == nil {
+				lookupHost = net.LookupHost
+			}
+			addrs, err := lookupHost(helo)
+			return err == nil && len(addrs) > 0
+		}, &Error{Code: 450, EnhancedCode: "4.7.1", Message: "Helo command rejected: host not found"}},
+	}
+}
+
+// Return the IP address of an address literal (RFC 5321 section 4.1.3), or nil.
+func addressLiteral(helo string) net.IP {
+	if !strings.HasPrefix(helo, "[") || !strings.HasSuffix(helo, "]") {
+		return nil
+	}
+	addr := helo[1 : len(helo)-1]
+	if strings.HasPrefix(strings.ToUpper(addr), "IPV6:") {
+		if ip := net.ParseIP(addr[5:]); ip != nil && ip.To4() == nil {
+			return ip
+		}
+		return nil
+	}
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+		return ip
+	}
+	return nil
+}
+
+// Return whether the name is a syntactically valid fully qualified domain name.
+func isFQDN(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	// Top level domains are not numeric.
+	return strings.Trim(labels[len(labels)-1], "0123456789") != ""
+}
+
+// Check the name given with HELO or EHLO, replying and returning false if it
+// is rejected.
+func (s *session) checkHelo(helo string) bool {
+	var failures []string
+	if p := s.srv.HeloPolicy; p != nil {
+		for _, check := range p.checks() {
+			if check.action == HeloIgnore || check.passes(s, helo) {
+				continue
+			}
+			if check.action == HeloReject {
+				s.log(LogWarn, "helo rejected", "name", helo, "error", check.name)
+				s.replyError(check.reply)
+				return false
+			}
+			failures = append(failures, check.name)
+		}
+		if len(failures) > 0 {
+			s.log(LogInfo, "helo check failed", "name", helo, "failures", strings.Join(failures, ","))
+		}
+	}
+	previous := s.heloFailures
+	s.heloFailures = failures
+	if s.srv.HandlerHelo != nil {
+		info := s.info()
+		info.Helo = helo
+		if err := s.srv.HandlerHelo(info); err != nil {
+			s.heloFailures = previous
+			s.log(LogWarn, "helo rejected", "name", helo, "error", err)
+			if serr, ok := err.(*Error); ok {
+				s.replyError(serr)
+			} else {
+				s.reply(451, "4.3.0", "Requested action aborted: local error in processing")
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestHeloPolicy(t *testing.T) {
+	policy := &HeloPolicy{
+		Empty:   HeloReject,
+		BareIP:  HeloReject,
+		FQDN:    HeloReject,
+		Own:     HeloReject,
+		Resolve: HeloReject,
+		LookupHost: func(host string) ([]string, error) {
+			if host == "unknown.example.com" {
+				return nil, errors.New("no such host")
+			}
+			return []string{"192.0.2.1"}, nil
+		},
+	}
+	server := &Server{
+		Hostname:   "mx.example.com",
+		HeloPolicy: policy,
+		HandlerHelo: func(info *SessionInfo) error {
+			if info.Helo == "blocked.example.com" {
+				return &Error{Code: 554, EnhancedCode: "5.7.1", Message: "Go away"}
+			}
+			return nil
+		},
+	}
+
+	tests := []struct {
+		helo string
+		code int
+	}{
+		{"host.example.com", 250},
+		{"host.example.com.", 250},
+		{"[192.0.2.1]", 250},
+		{"[IPv6:2001:db8::1]", 250},
+		{"", 501},
+		{"192.0.2.1", 501},
+		{"localhost", 504},
+		{"host_name.example.com", 504},
+		{"[IPv6:192.0.2.1]", 504},
+		{"MX.example.com", 550},
+		{"unknown.example.com", 450},
+		{"blocked.example.com", 554},
+	}
+	for _, tt := range tests {
+		for _, verb := range []string{"HELO", "EHLO"} {
+			conn := newConn(t, server)
+			cmdCode(t, conn, strings.TrimSpace(verb+" "+tt.helo), tt.code)
+			cmdCode(t, conn, "QUIT", 221)
+			conn.Close()
+		}
+	}
+
+	// Failures of checks set to HeloScore are passed on to HandlerHelo and
+	// the handler.
+	policy.FQDN = HeloScore
+	policy.Resolve = HeloScore
+	var heloFailures, failures []string
+	server.HandlerHelo = func(info *SessionInfo) error {
+		heloFailures = info.HeloFailures
+		return nil
+	}
+	server.HandlerContext = func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		failures = SessionFromContext(ctx).HeloFailures
+		_, err := io.Copy(ioutil.Discard, body)
+		return err
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO localhost", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: Test\r\n\r\nHello.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+	if strings.Join(failures, ",") != "not_fqdn" || strings.Join(heloFailures, ",") != "not_fqdn" {
+		t.Errorf("HELO failures %q, %q in HandlerHelo", failures, heloFailures)
+	}
+}
@@ -0,0 +1,57 @@
+package smtpd
+
+import (
+	"strings"
+)
+
+// Syntax of each command, replied to HELP with the command as topic.
+var helpTopics = map[string]string{
+	"HELO":     "HELO <domain>\nIdentify the client to the server.",
+	"EHLO":     "EHLO <domain>\nIdentify the client to the server and list the supported extensions.",
+	"MAIL":     "MAIL FROM:<reverse-path> [SIZE=<size>]\nStart a mail transaction from the sender.",
+	"RCPT":     "RCPT TO:<forward-path>\nAdd a recipient to the mail transaction.",
+	"DATA":     "DATA\nSend the message, ending with a line holding a single \".\".",
+	"RSET":     "RSET\nAbort the mail transaction.",
+	"NOOP":     "NOOP\nDo nothing.",
+	"QUIT":     "QUIT\nClose the connection.",
+	"HELP":     "HELP [topic]\nShow the commands, or help on one of them.",
+	"VRFY":     "VRFY <user or address>\nVerify a mailbox.",
+	"EXPN":     "EXPN <mailing list>\nList the members of a mailing list.",
+	"STARTTLS": "STARTTLS\nStart a TLS session.",
+}
+
+// Return the commands the server implements, in the order they are listed by HELP.
+func (srv *Server) commands() []string {
+	commands := []string{"HELO", "EHLO", "MAIL", "RCPT", "DATA", "RSET", "NOOP", "QUIT", "HELP"}
+	for _, verb := range []string{"VRFY", "EXPN"} {
+		if srv.Vrfy.implements(verb) {
+			commands = append(commands, verb)
+		}
+	}
+	if srv.TLSConfig != nil {
+		commands = append(commands, "STARTTLS")
+	}
+	return commands
+}
+
+// Reply to a HELP command with the text for the topic, if any.
+func (s *session) help(topic string) {
+	topic = strings.ToUpper(strings.TrimSpace(topic))
+	text, ok := s.srv.Help[topic]
+	if !ok && topic == "" {
+		text, ok = "Commands:\n  "+strings.Join(s.srv.commands(), " ")+"\nExtensions:\n  "+strings.Join(s.extensions(), " ")+
+			"\nFor more information use \"HELP <topic>\".", true
+	} else if !ok {
+		for _, command := range s.srv.commands() {
+			if command == topic {
+				text, ok = helpTopics[topic], true
+			}
+		}
+	}
+	if !ok {
+		s.writef("504 5.5.4 HELP topic unknown")
+		return
+	}
+
+	s.reply(214, "2.0.0", strings.Split(strings.TrimRight(text, "\n"), "\n")...)
+}
@@ -0,0 +1,40 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestHelp(t *testing.T) {
+	server := &Server{MaxSize: 1000}
+	conn := newConn(t, server)
+	want := "2.0.0 Commands:\n2.0.0   HELO EHLO MAIL RCPT DATA RSET NOOP QUIT HELP\n" +
+		"2.0.0 Extensions:\n2.0.0   SIZE 1000 ENHANCEDSTATUSCODES\n2.0.0 For more information use \"HELP <topic>\"."
+	if msg := cmdCode(t, conn, "HELP", 214); msg != want {
+		t.Errorf("HELP replied %q, want %q", msg, want)
+	}
+	if msg := cmdCode(t, conn, "HELP rcpt", 214); msg != "2.0.0 RCPT TO:<forward-path>\n2.0.0 Add a recipient to the mail transaction." {
+		t.Errorf("HELP RCPT replied %q", msg)
+	}
+	cmdCode(t, conn, "HELP VRFY", 504)
+	cmdCode(t, conn, "HELP UNKNOWN", 504)
+	conn.Close()
+
+	// Enabled features are listed, and the text can be replaced.
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.Vrfy = &VrfyPolicy{Verify: func(query string) ([]string, error) { return nil, nil }}
+	server.Help = map[string]string{"VRFY": "VRFY is for monitoring only.", "X-CUSTOM": "Custom topic\nwith 100% more lines\n"}
+	conn = newConn(t, server)
+	want = "2.0.0 Commands:\n2.0.0   HELO EHLO MAIL RCPT DATA RSET NOOP QUIT HELP VRFY STARTTLS\n" +
+		"2.0.0 Extensions:\n2.0.0   SIZE 1000 STARTTLS ENHANCEDSTATUSCODES\n2.0.0 For more information use \"HELP <topic>\"."
+	if msg := cmdCode(t, conn, "HELP", 214); msg != want {
+		t.Errorf("HELP replied %q, want %q", msg, want)
+	}
+	if msg := cmdCode(t, conn, "HELP VRFY", 214); msg != "2.0.0 VRFY is for monitoring only." {
+		t.Errorf("HELP VRFY replied %q", msg)
+	}
+	if msg := cmdCode(t, conn, "HELP x-custom", 214); msg != "2.0.0 Custom topic\n2.0.0 with 100% more lines" {
+		t.Errorf("HELP X-CUSTOM replied %q", msg)
+	}
+	conn.Close()
+}
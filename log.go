@@ -0,0 +1,185 @@
+package smtpd
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+// Log levels, from most to least verbose.
+const (
+	LogDebug LogLevel = iota // Protocol I/O
+	LogInfo                  // Session lifecycle: connect, TLS, MAIL, RCPT, DATA, disconnect
+	LogWarn                  // Rejected or failed operations
+	LogError                 // Server errors
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(l)) + ")"
+}
+
+// Logger receives the server's log entries. Each entry has a level, a message
+// and alternating key/value pairs such as "session", "remote_ip", "helo" and "from".
+// A Logger may be called from many sessions at once.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(level LogLevel, msg string, keyvals ...interface{})
+
+// Log calls f(level, msg, keyvals...).
+func (f LoggerFunc) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	f(level, msg, keyvals...)
+}
+
+// NewLogger returns a Logger writing entries at or above level to w, one per
+// line in logfmt style: time=... level=info msg="..." key=value ...
+func NewLogger(w io.Writer, level LogLevel) Logger {
+	return &textLogger{w: w, level: level}
+}
+
+type textLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level LogLevel
+}
+
+func (l *textLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	if level < l.level {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("time=" + time.Now().Format(time.RFC3339))
+	b.WriteString(" level=" + level.String())
+	b.WriteString(" msg=" + logfmtValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		b.WriteString(" " + fmt.Sprint(keyvals[i]) + "=" + logfmtValue(fmt.Sprint(v)))
+	}
+	b.WriteString("\n")
+
+	l.mu.Lock()
+	io.WriteString(l.w, b.String())
+	l.mu.Unlock()
+}
+
+// logfmtValue quotes v if it is empty or contains spaces, quotes or '='.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// nopLogger discards every entry.
+type nopLogger struct{}
+
+func (nopLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {}
+
+// Return the logger for the server. Setting the deprecated Debug flag without
+// a Logger logs everything through the standard log package.
+func (srv *Server) logger() Logger {
+	if srv.Logger != nil {
+		return srv.Logger
+	}
+	if Debug {
+		return debugLogger
+	}
+	return nopLogger{}
+}
+
+var debugLogger = NewLogger(logWriter{}, LogDebug)
+
+// logWriter writes to the standard logger at call time, so log.SetOutput is honoured.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	return len(p), log.Output(2, string(p))
+}
+
+// tlsVersionName returns the name of a TLS version for logs.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// newSessionID returns a random identifier used to correlate a session's log entries.
+func newSessionID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Log an entry for the session, adding the session ID, remote IP and, once
+// known, the HELO name and sender.
+func (s *session) log(level LogLevel, msg string, keyvals ...interface{}) {
+	fields := []interface{}{"session", s.id, "remote_ip", s.remoteIP}
+	if s.remoteName != "" {
+		fields = append(fields, "helo", s.remoteName)
+	}
+	if s.gotFrom {
+		fields = append(fields, "from", s.from)
+	}
+	s.srv.logger().Log(level, msg, append(fields, keyvals...)...)
+}
+
+// Log a line read from the client, passing it to LogRead if set.
+func (s *session) logRead(line string) {
+	line = redactAuth(line)
+	s.log(LogDebug, "read", "line", line)
+	if s.srv.LogRead != nil {
+		s.srv.LogRead(s.remoteIP, "READ", line)
+	}
+}
+
+// Log a line written to the client, passing it to LogWrite if set.
+func (s *session) logWrite(line string) {
+	s.log(LogDebug, "write", "line", line)
+	if s.srv.LogWrite != nil {
+		s.srv.LogWrite(s.remoteIP, "WROTE", line)
+	}
+}
+
+// redactAuth hides the credentials in an AUTH command, keeping the mechanism.
+func redactAuth(line string) string {
+	fields := strings.Fields(line)
+	if len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+		return fields[0] + " " + fields[1] + " [redacted]"
+	}
+	return line
+}
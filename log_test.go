@@ -0,0 +1,135 @@
+package smtpd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type logEntry struct {
+	level  LogLevel
+	msg    string
+	fields map[string]string
+}
+
+// Logger collecting entries for inspection, signalling when a session ends.
+type testLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+	closed  chan struct{}
+}
+
+func newTestLogger() *testLogger {
+	return &testLogger{closed: make(chan struct{})}
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, keyvals ...interface{}) {
+	fields := make(map[string]string)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+	l.mu.Unlock()
+	if msg == "connection closed" {
+		close(l.closed)
+	}
+}
+
+// Return the first entry with the given message.
+func (l *testLogger) find(msg string) (logEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.entries {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return logEntry{}, false
+}
+
+func TestLogger(t *testing.T) {
+	logger := newTestLogger()
+	var reads, writes []string
+	server := &Server{
+		Logger: logger,
+		LogRead: func(remoteIP, verb, line string) {
+			reads = append(reads, verb+" "+line)
+		},
+		LogWrite: func(remoteIP, verb, line string) {
+			writes = append(writes, verb+" "+line)
+		},
+	}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "AUTH PLAIN AHVzZXIAc2VjcmV0", 502)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Test message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+	<-logger.closed
+
+	opened, ok := logger.find("connection opened")
+	if !ok {
+		t.Fatal("connection opened was not logged")
+	}
+	session := opened.fields["session"]
+	if session == "" {
+		t.Error("session ID missing")
+	}
+
+	accepted, ok := logger.find("message accepted")
+	if !ok {
+		t.Fatal("message accepted was not logged")
+	}
+	if accepted.level != LogInfo || accepted.fields["session"] != session || accepted.fields["helo"] != "host.example.com" ||
+		accepted.fields["from"] != "sender@example.com" || accepted.fields["rcpts"] != "1" || accepted.fields["bytes"] != "14" {
+		t.Errorf("message accepted logged as %+v", accepted)
+	}
+
+	closed, _ := logger.find("connection closed")
+	if closed.fields["reason"] != "quit" {
+		t.Errorf("connection closed with reason %q, want quit", closed.fields["reason"])
+	}
+
+	// AUTH credentials must never be logged.
+	for _, e := range logger.entries {
+		if strings.Contains(e.fields["line"], "AHVzZXIAc2VjcmV0") {
+			t.Errorf("credentials logged in %+v", e)
+		}
+	}
+	for _, line := range reads {
+		if strings.Contains(line, "AHVzZXIAc2VjcmV0") {
+			t.Errorf("credentials passed to LogRead in %q", line)
+		}
+	}
+
+	// LogRead and LogWrite still receive the protocol I/O.
+	if len(reads) == 0 || reads[0] != "READ EHLO host.example.com" {
+		t.Errorf("LogRead received %q", reads)
+	}
+	if len(writes) == 0 || !strings.HasPrefix(writes[0], "WROTE 220 ") {
+		t.Errorf("LogWrite received %q", writes)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LogInfo)
+	logger.Log(LogDebug, "read", "line", "NOOP")
+	logger.Log(LogWarn, "rcpt rejected", "session", "abc", "to", "a b@example.com", "odd")
+
+	line := buf.String()
+	if strings.Count(line, "\n") != 1 {
+		t.Fatalf("NewLogger wrote %q, want one line", line)
+	}
+	want := ` level=warn msg="rcpt rejected" session=abc to="a b@example.com" odd=(missing)` + "\n"
+	if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, want) {
+		t.Errorf("NewLogger wrote %q, want suffix %q", line, want)
+	}
+}
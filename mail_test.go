@@ -0,0 +1,96 @@
+package smtpd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHandlerMail(t *testing.T) {
+	var params, dataParams map[string]string
+	server := &Server{
+		MaxSize: 1000,
+		HandlerMail: func(remoteAddr net.Addr, from string, p map[string]string) error {
+			params = p
+			switch {
+			case strings.HasSuffix(from, "@spam.example.com"):
+				return &Error{Code: 550, EnhancedCode: "5.7.1", Message: "Sender domain blocked"}
+			case from == "broken@example.com":
+				return errors.New("database unavailable")
+			case p["SIZE"] == "900":
+				return &Error{Code: 552, EnhancedCode: "5.2.2", Message: "Over quota"}
+			}
+			return nil
+		},
+		HandlerContext: func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			dataParams = SessionFromContext(ctx).MailParams
+			_, err := io.Copy(ioutil.Discard, body)
+			return err
+		},
+	}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> size=100 BODY=8BITMIME SMTPUTF8 RET=HDRS ENVID=QQ314159 AUTH=<>", 250)
+	want := map[string]string{"SIZE": "100", "BODY": "8BITMIME", "SMTPUTF8": "", "RET": "HDRS", "ENVID": "QQ314159", "AUTH": "<>"}
+	if !reflect.DeepEqual(params, want) {
+		t.Errorf("HandlerMail called with %v, want %v", params, want)
+	}
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: Test\r\n\r\nHello.\r\n.", 250)
+	if !reflect.DeepEqual(dataParams, want) {
+		t.Errorf("SessionInfo.MailParams %v, want %v", dataParams, want)
+	}
+
+	if msg := cmdCode(t, conn, "MAIL FROM:<sender@spam.example.com>", 550); msg != "5.7.1 Sender domain blocked" {
+		t.Errorf("MAIL replied %q", msg)
+	}
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 503)
+	cmdCode(t, conn, "MAIL FROM:<broken@example.com>", 451)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SIZE=900", 552)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SIZE=2000", 552)
+	if msg := cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=7BIT body=8BITMIME", 501); !strings.Contains(msg, "duplicate BODY parameter") {
+		t.Errorf("MAIL replied %q", msg)
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> =x", 501)
+	cmdCode(t, conn, "MAIL FROM:<> RET=FULL", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestAllowedMailParams(t *testing.T) {
+	server := &Server{AllowedMailParams: []string{"BODY", "smtputf8", "RET", "ENVID", "AUTH"}}
+	conn := newConn(t, server)
+	if msg := cmdCode(t, conn, "EHLO host.example.com", 250); !strings.HasSuffix(msg, "\nSIZE 0\n8BITMIME\nSMTPUTF8\nENHANCEDSTATUSCODES") {
+		t.Errorf("EHLO replied %q", msg)
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=8BITMIME SMTPUTF8 RET=HDRS ENVID=x AUTH=<>", 250)
+	conn.Close()
+
+	server = &Server{AllowedMailParams: []string{"BODY"}}
+	conn = newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	if msg := cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=8BITMIME XFOO=1 SMTPUTF8", 555); msg != "5.5.4 MAIL FROM parameter SMTPUTF8 not recognized or not implemented" {
+		t.Errorf("MAIL replied %q", msg)
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> =x", 501)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> SIZE=100 body=7BIT", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Any parameter is accepted by default.
+	server = &Server{}
+	conn = newConn(t, server)
+	if msg := cmdCode(t, conn, "EHLO host.example.com", 250); strings.Contains(msg, "8BITMIME") {
+		t.Errorf("EHLO replied %q", msg)
+	}
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> BODY=8BITMIME XFOO=1", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
@@ -0,0 +1,225 @@
+package smtpd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Maildir delivers messages to Maildir directories (https://cr.yp.to/proto/maildir.html).
+// Its Deliver method is a Handler, and its Verify method an RcptVerifier
+// checking each recipient's quota.
+//
+// The message is written once. Each recipient's copy is a hard link to it
+// unless the Maildirs are on different file systems. If delivery fails part
+// way the message is rejected, so recipients already delivered to may
+// receive it again when the client retries.
+type Maildir struct {
+	Dir         string                            // Maildir used for every recipient if Resolve is nil
+	Resolve     func(rcpt string) (string, error) // Returns the Maildir of a recipient; an error rejects the recipient or message
+	DeliveredTo bool                              // Add a Delivered-To field for each recipient, seen by all of them as the copies are shared
+	Quota       func(rcpt, dir string) bool       // Reports whether the recipient's Maildir has room for new messages
+	Sync        bool                              // fsync each file and directory before accepting the message
+}
+
+// errMailboxFull is returned when a recipient's quota would be exceeded.
+var errMailboxFull = &Error{Code: 452, EnhancedCode: "4.2.2", Message: "Mailbox full"}
+
+// Verify checks that a recipient's Maildir can be resolved and, if Quota is
+// set, that it is not full, replying 452 4.2.2 otherwise. Checking quotas on
+// RCPT only rejects the recipients concerned, where Deliver can only reject
+// the whole message.
+func (md *Maildir) Verify(remoteAddr net.Addr, from string, to string) error {
+	dir, err := md.dir(to)
+	if err != nil {
+		return err
+	}
+	if md.Quota != nil && !md.Quota(to, dir) {
+		return errMailboxFull
+	}
+	return nil
+}
+
+// Deliver writes the message to the Maildir of every recipient. Missing
+// Maildirs are created. A Return-Path field with the sender is added.
+func (md *Maildir) Deliver(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	if len(to) == 0 {
+		return nil
+	}
+	dirs := make([]string, len(to))
+	for i, rcpt := range to {
+		dir, err := md.dir(rcpt)
+		if err != nil {
+			return err
+		}
+		if err := makeMaildir(dir); err != nil {
+			return err
+		}
+		dirs[i] = dir
+	}
+
+	// Write the message once to the tmp directory of the first Maildir, with
+	// the header fields shared by every recipient.
+	header := "Return-Path: <" + from + ">\n"
+	if md.DeliveredTo {
+		for _, rcpt := range to {
+			header += "Delivered-To: " + rcpt + "\n"
+		}
+	}
+	tmp := filepath.Join(dirs[0], "tmp", maildirName(0))
+	size, err := writeFile(tmp, header, body, md.Sync)
+	defer os.Remove(tmp)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := md.link(tmp, dir, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the Maildir of rcpt.
+func (md *Maildir) dir(rcpt string) (string, error) {
+	if md.Resolve != nil {
+		return md.Resolve(rcpt)
+	}
+	return md.Dir, nil
+}
+
+// Write header followed by body to a new file, returning its size. The file
+// is fsynced if sync is set.
+func writeFile(name, header string, body io.Reader, sync bool) (int64, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.WriteString(f, header)
+	size := int64(n)
+	if err == nil {
+		n, err := io.Copy(f, body)
+		size += n
+		if err != nil {
+			f.Close()
+			return size, err
+		}
+	}
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return size, err
+}
+
+// Deliver the file tmp of the given size to the new directory of dir with a
+// hard link, falling back to a copy.
+func (md *Maildir) link(tmp, dir string, size int64) error {
+	name := filepath.Join(dir, "new", maildirName(size))
+	if err := os.Link(tmp, name); err != nil {
+		return md.copy(tmp, dir)
+	}
+	return syncDir(filepath.Join(dir, "new"), md.Sync)
+}
+
+// Deliver a copy of tmp to dir, through its tmp directory.
+func (md *Maildir) copy(tmp, dir string) error {
+	src, err := os.Open(tmp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	name := maildirName(0)
+	dst := filepath.Join(dir, "tmp", name)
+	size, err := writeFile(dst, "", src, md.Sync)
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	if err := os.Rename(dst, filepath.Join(dir, "new", name+",S="+fmt.Sprint(size))); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return syncDir(filepath.Join(dir, "new"), md.Sync)
+}
+
+// fsync a directory if sync is set, so a new entry in it is durable.
+func syncDir(dir string, sync bool) error {
+	if !sync {
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Create the tmp, new and cur directories of a Maildir.
+func makeMaildir(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var maildirCounter uint64
+
+// Return a unique file name as described in the Maildir specification, with
+// the size appended as ",S=<size>" if it is known.
+func maildirName(size int64) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.Replace(host, "/", `\057`, -1)
+	host = strings.Replace(host, ":", `\072`, -1)
+
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&maildirCounter, 1), host)
+	if size > 0 {
+		name += fmt.Sprintf(",S=%d", size)
+	}
+	return name
+}
+
+// MaildirSize returns the total size of the messages in the new and cur
+// directories of a Maildir, for use in quota checks.
+func MaildirSize(dir string) (int64, error) {
+	var size int64
+	for _, sub := range []string{"new", "cur"} {
+		f, err := os.Open(filepath.Join(dir, sub))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		infos, err := f.Readdir(-1)
+		f.Close()
+		if err != nil {
+			return 0, err
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				size += info.Size()
+			}
+		}
+	}
+	return size, nil
+}
@@ -0,0 +1,157 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Return the files delivered to the new directory of a Maildir, by name.
+func maildirMessages(t *testing.T, dir string) map[string]string {
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(map[string]string)
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(file, ",S="+strconv.Itoa(len(b))) {
+			t.Errorf("file name %s does not end with the size %d", file, len(b))
+		}
+		messages[file] = string(b)
+	}
+	if tmp, _ := filepath.Glob(filepath.Join(dir, "tmp", "*")); len(tmp) > 0 {
+		t.Errorf("files left in tmp: %q", tmp)
+	}
+	return messages
+}
+
+const maildirTestMessage = "Subject: Test\r\n\r\nTest message."
+
+func TestMaildir(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	md := &Maildir{
+		Resolve: func(rcpt string) (string, error) {
+			if strings.HasPrefix(rcpt, "unknown@") {
+				return "", &Error{Code: 550, EnhancedCode: "5.1.1", Message: "No such user"}
+			}
+			return filepath.Join(root, strings.Split(rcpt, "@")[0]), nil
+		},
+		Sync: true,
+	}
+	server := &Server{Handler: md.Deliver}
+
+	sendMessage(t, server, maildirTestMessage, 250, "alice@example.com", "bob@example.com")
+	alice := maildirMessages(t, filepath.Join(root, "alice"))
+	bob := maildirMessages(t, filepath.Join(root, "bob"))
+	if len(alice) != 1 || len(bob) != 1 {
+		t.Fatalf("delivered %d and %d messages, want 1 each", len(alice), len(bob))
+	}
+	want := "Return-Path: <sender@example.com>\nSubject: Test\n\nTest message.\n"
+	var files []string
+	for file, msg := range alice {
+		if msg != want {
+			t.Errorf("delivered %q, want %q", msg, want)
+		}
+		files = append(files, file)
+	}
+	for file := range bob {
+		files = append(files, file)
+	}
+
+	// The recipients share one file.
+	info1, err1 := os.Stat(files[0])
+	info2, err2 := os.Stat(files[1])
+	if err1 != nil || err2 != nil || !os.SameFile(info1, info2) {
+		t.Errorf("copies are not hard linked: %v %v", err1, err2)
+	}
+
+	// Resolver errors reject the message, with their reply if they carry one.
+	sendMessage(t, server, maildirTestMessage, 550, "unknown@example.com")
+	if err := md.Verify(nil, "sender@example.com", "unknown@example.com"); err == nil || !strings.HasPrefix(err.Error(), "550 5.1.1 ") {
+		t.Errorf("Verify returned %v", err)
+	}
+	if err := md.Verify(nil, "sender@example.com", "alice@example.com"); err != nil {
+		t.Errorf("Verify returned %v", err)
+	}
+}
+
+func TestMaildirDeliveredTo(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	md := &Maildir{Dir: root, DeliveredTo: true}
+	sendMessage(t, &Server{Handler: md.Deliver}, maildirTestMessage, 250, "alice@example.com", "bob@example.com")
+
+	// Both recipients share one file, carrying a field for each.
+	var files []string
+	want := "Return-Path: <sender@example.com>\nDelivered-To: alice@example.com\nDelivered-To: bob@example.com\nSubject: Test\n\nTest message.\n"
+	for file, msg := range maildirMessages(t, root) {
+		if msg != want {
+			t.Errorf("delivered %q, want %q", msg, want)
+		}
+		files = append(files, file)
+	}
+	if len(files) != 2 {
+		t.Fatalf("delivered %d messages, want 2", len(files))
+	}
+	info1, err1 := os.Stat(files[0])
+	info2, err2 := os.Stat(files[1])
+	if err1 != nil || err2 != nil || !os.SameFile(info1, info2) {
+		t.Errorf("copies are not hard linked: %v %v", err1, err2)
+	}
+}
+
+func TestMaildirQuota(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	md := &Maildir{
+		Resolve: func(rcpt string) (string, error) {
+			return filepath.Join(root, strings.Split(rcpt, "@")[0]), nil
+		},
+		Quota: func(rcpt, dir string) bool {
+			used, err := MaildirSize(dir)
+			return err == nil && used < 50
+		},
+	}
+	server := &Server{Handler: md.Deliver, VerifyRcpt: md.Verify}
+
+	// After the first message alice is over quota, so only she is rejected
+	// and bob still receives the second.
+	sendMessage(t, server, maildirTestMessage, 250, "alice@example.com")
+	conn := newConn(t, server)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<bob@example.com>", 250)
+	if msg := cmdCode(t, conn, "RCPT TO:<alice@example.com>", 452); !strings.HasPrefix(msg, "4.2.2 ") {
+		t.Errorf("quota exceeded replied %q", msg)
+	}
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: Test\r\n\r\nTest message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	if n := len(maildirMessages(t, filepath.Join(root, "alice"))); n != 1 {
+		t.Errorf("alice has %d messages, want 1", n)
+	}
+	if n := len(maildirMessages(t, filepath.Join(root, "bob"))); n != 1 {
+		t.Errorf("bob has %d messages, want 1", n)
+	}
+}
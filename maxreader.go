@@ -22,3 +22,33 @@ func (r *MaxReader) Read(p []byte) (n int, err error) {
 	}
 	return n, err
 }
+
+// lineLimitReader checks the length of each line of the DATA body, after
+// textproto.DotReader has converted line endings to LF. Lines over the limit
+// are counted, or rejected with lineTooLongError.
+type lineLimitReader struct {
+	Reader io.Reader
+	limit  int // Including CRLF
+	reject bool
+	n      int // Length of the current line so far
+	long   int // Number of lines over the limit
+}
+
+func (r *lineLimitReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	for i, c := range p[:n] {
+		if c == '\n' {
+			r.n = 0
+			continue
+		}
+		r.n++
+		// The line no longer fits with its CRLF.
+		if r.n == r.limit-1 {
+			r.long++
+			if r.reject {
+				return i, lineTooLongError{r.limit}
+			}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,148 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// MboxFormat is the variant of the mbox format written by Mbox.
+type MboxFormat int
+
+const (
+	MboxRD  MboxFormat = iota // Body lines matching ">*From " gain a leading ">"
+	MboxCL2                   // A Content-Length field gives the body length and the body is not quoted
+)
+
+// Mbox appends messages to an mbox file. Its Deliver method is a Handler.
+//
+// The file is locked with flock(2) while a message is appended, so mail
+// readers using flock see complete messages. In MboxRD format the message is
+// streamed to the file as it is received and the lock is held meanwhile; in
+// MboxCL2 format it is read into memory first to count the body. If the
+// message cannot be written in full, e.g. because it exceeds Server.MaxSize,
+// the file is truncated back to its previous length.
+type Mbox struct {
+	Path   string     // mbox file, created if missing
+	Format MboxFormat // MboxRD by default
+	Sync   bool       // fsync the file before accepting the message
+}
+
+// Deliver appends the message to the mbox file, with a "From " line giving
+// the sender and the time received.
+func (mb *Mbox) Deliver(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	var msg []byte
+	if mb.Format == MboxCL2 {
+		var err error
+		if msg, err = ioutil.ReadAll(body); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(mb.Path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(mboxFromLine(from, time.Now()))
+	if mb.Format == MboxCL2 {
+		err = writeMboxcl2(w, msg)
+	} else {
+		err = writeMboxrd(w, body)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && mb.Sync {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(end)
+		return err
+	}
+	return nil
+}
+
+// Return the "From " line starting a message in an mbox file.
+func mboxFromLine(from string, t time.Time) string {
+	if from == "" {
+		from = "MAILER-DAEMON"
+	}
+	return "From " + from + " " + t.UTC().Format(time.ANSIC) + "\n"
+}
+
+// Write a message in mboxrd format, quoting "From " lines, followed by the
+// empty line separating it from the next.
+func writeMboxrd(w *bufio.Writer, body io.Reader) error {
+	r := bufio.NewReader(body)
+	bol := true // At the beginning of a line
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(line) > 0 {
+			if bol && bytes.HasPrefix(bytes.TrimLeft(line, ">"), []byte("From ")) {
+				w.WriteByte('>')
+			}
+			w.Write(line)
+			bol = line[len(line)-1] == '\n'
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+	if !bol {
+		w.WriteByte('\n')
+	}
+	return w.WriteByte('\n')
+}
+
+// Write a message in mboxcl2 format, replacing any Content-Length field with
+// the length of the body, followed by the empty line separating it from the next.
+func writeMboxcl2(w *bufio.Writer, msg []byte) error {
+	if len(msg) > 0 && msg[len(msg)-1] != '\n' {
+		msg = append(msg, '\n')
+	}
+	header, body := msg, []byte(nil)
+	if bytes.HasPrefix(msg, []byte("\n")) {
+		header, body = nil, msg[1:]
+	} else if i := bytes.Index(msg, []byte("\n\n")); i >= 0 {
+		header, body = msg[:i+1], msg[i+2:]
+	}
+
+	skip := false // In a Content-Length field, including continuation lines
+	for len(header) > 0 {
+		i := bytes.IndexByte(header, '\n')
+		line := header[:i+1]
+		header = header[i+1:]
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if j := bytes.IndexByte(line, ':'); j >= 0 {
+				name = line[:j]
+			}
+			skip = bytes.EqualFold(bytes.TrimSpace(name), []byte("Content-Length"))
+		}
+		if !skip {
+			w.Write(line)
+		}
+	}
+	w.WriteString("Content-Length: " + strconv.Itoa(len(body)) + "\n\n")
+	w.Write(body)
+	return w.WriteByte('\n')
+}
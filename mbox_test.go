@@ -0,0 +1,47 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var mboxFromRE = regexp.MustCompile(`(?m)^From sender@example\.com \w{3} \w{3} [ \d]\d \d\d:\d\d:\d\d \d{4}$`)
+
+func TestMbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		format MboxFormat
+		want   string
+	}{
+		{MboxRD, "From DATE\nSubject: Test\nContent-Length: 3\n\n>From here\n>>From there\n From nowhere\n\n" +
+			"From DATE\nSubject: Second\n\nNo newline\n\n"},
+		{MboxCL2, "From DATE\nSubject: Test\nContent-Length: 36\n\nFrom here\n>From there\n From nowhere\n\n" +
+			"From DATE\nSubject: Second\nContent-Length: 11\n\nNo newline\n\n"},
+	}
+	for _, tt := range tests {
+		mb := &Mbox{Path: filepath.Join(dir, "mbox"), Format: tt.format, Sync: true}
+		server := &Server{Handler: mb.Deliver, MaxSize: 100}
+		sendMessage(t, server, "Subject: Test\r\nContent-Length: 3\r\n\r\nFrom here\r\n>From there\r\n From nowhere", 250)
+		// Partial messages are removed.
+		sendMessage(t, server, "Subject: Big\r\n\r\n"+strings.Repeat("Too long.\r\n", 20), 552)
+		sendMessage(t, server, "Subject: Second\r\n\r\nNo newline", 250)
+
+		b, err := ioutil.ReadFile(mb.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := mboxFromRE.ReplaceAllString(string(b), "From DATE"); got != tt.want {
+			t.Errorf("format %d: mbox is %q, want %q", tt.format, got, tt.want)
+		}
+		os.Remove(mb.Path)
+	}
+}
@@ -0,0 +1,229 @@
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// Messages larger than this are buffered in a temporary file instead of memory.
+const memoryBufferSize = 1 << 20
+
+// headerField is a single header field as it appeared in the message,
+// including any folding and the trailing line ending.
+type headerField struct {
+	name string
+	raw  string
+}
+
+// value returns the unfolded field body without leading or trailing whitespace.
+func (f headerField) value() string {
+	v := f.raw[strings.Index(f.raw, ":")+1:]
+	v = strings.Replace(v, "\r\n", "", -1)
+	v = strings.Replace(v, "\n", "", -1)
+	return strings.TrimSpace(v)
+}
+
+// newHeaderField creates a header field from a name and a (possibly folded)
+// value, terminated with eol.
+func newHeaderField(name, value, eol string) headerField {
+	return headerField{name: name, raw: name + ": " + value + eol}
+}
+
+// message is a received message with the header parsed into fields and the
+// body buffered so it can be read more than once.
+type message struct {
+	header []headerField
+	eol    string // line ending used by the message, "\r\n" or "\n"
+	sep    string // blank line separating the header from the body, if any
+	body   bodyBuffer
+}
+
+// messageFilter inspects or modifies a buffered message before it is passed to the Handler.
+type messageFilter func(remoteAddr net.Addr, from string, to []string, msg *message) error
+
+// filterHandler returns a Handler that buffers the message, applies filters in
+// order, then passes the result on to next.
+func filterHandler(filters []messageFilter, next Handler) Handler {
+	return func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		msg, err := readMessage(body)
+		if err != nil {
+			return err
+		}
+		defer msg.Close()
+
+		for _, filter := range filters {
+			if err = filter(remoteAddr, from, to, msg); err != nil {
+				return err
+			}
+		}
+		return next(remoteAddr, from, to, msg.Reader())
+	}
+}
+
+// readMessage reads r to the end, parsing the header block and buffering the body.
+// The caller must Close the message to release any temporary file.
+func readMessage(r io.Reader) (*message, error) {
+	m := &message{eol: "\r\n"}
+	br := bufio.NewReader(r)
+
+	// Read header fields up to the blank line separating them from the body.
+	// A line that is not a field or a continuation ends the header early and
+	// is kept as the first line of the body.
+	var rest string
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" && len(m.header) == 0 && !strings.HasSuffix(line, "\r\n") && strings.HasSuffix(line, "\n") {
+			m.eol = "\n"
+		}
+		if line == "\r\n" || line == "\n" {
+			m.sep = line
+			break
+		}
+		if line != "" {
+			if (line[0] == ' ' || line[0] == '\t') && len(m.header) > 0 {
+				m.header[len(m.header)-1].raw += line
+			} else if idx := strings.Index(line, ":"); idx > 0 && isFieldName(line[:idx]) {
+				m.header = append(m.header, headerField{name: line[:idx], raw: line})
+			} else {
+				rest = line
+				break
+			}
+		}
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+	}
+
+	m.body.WriteString(rest)
+	if _, err := io.Copy(&m.body, br); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// isFieldName reports whether name is a valid RFC 5322 field name.
+func isFieldName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < 33 || name[i] > 126 {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// get returns every field with the given name, in message order.
+func (m *message) get(name string) (fields []headerField) {
+	for _, f := range m.header {
+		if strings.EqualFold(f.name, name) {
+			fields = append(fields, f)
+		}
+	}
+	return
+}
+
+// remove deletes every field for which match returns true.
+func (m *message) remove(match func(f headerField) bool) {
+	header := m.header[:0]
+	for _, f := range m.header {
+		if !match(f) {
+			header = append(header, f)
+		}
+	}
+	m.header = header
+}
+
+// mimeHeader returns the unfolded header fields keyed by canonical name.
+func (m *message) mimeHeader() textproto.MIMEHeader {
+	header := make(textproto.MIMEHeader)
+	for _, f := range m.header {
+		header.Add(f.name, f.value())
+	}
+	return header
+}
+
+// prepend adds fields to the top of the header, keeping their order.
+func (m *message) prepend(fields ...headerField) {
+	m.header = append(append([]headerField{}, fields...), m.header...)
+}
+
+// headerBytes returns the header block as it will be written, without the
+// blank line separating it from the body.
+func (m *message) headerBytes() []byte {
+	var buf bytes.Buffer
+	for _, f := range m.header {
+		buf.WriteString(f.raw)
+	}
+	return buf.Bytes()
+}
+
+// Reader returns a reader over the complete message, header then body.
+func (m *message) Reader() io.Reader {
+	return io.MultiReader(bytes.NewReader(m.headerBytes()), strings.NewReader(m.sep), m.body.Reader())
+}
+
+// Close releases the buffered body.
+func (m *message) Close() error {
+	return m.body.Close()
+}
+
+// bodyBuffer holds message data in memory, moving it to a temporary file once
+// it grows past memoryBufferSize.
+type bodyBuffer struct {
+	mem  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (b *bodyBuffer) Write(p []byte) (n int, err error) {
+	if b.file == nil && b.mem.Len()+len(p) > memoryBufferSize {
+		b.file, err = ioutil.TempFile("", "smtpd-")
+		if err != nil {
+			return 0, err
+		}
+		if _, err = b.file.Write(b.mem.Bytes()); err != nil {
+			return 0, err
+		}
+		b.mem.Reset()
+	}
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return
+}
+
+func (b *bodyBuffer) WriteString(s string) (int, error) {
+	return b.Write([]byte(s))
+}
+
+// Reader returns a new reader positioned at the start of the buffered data.
+func (b *bodyBuffer) Reader() io.Reader {
+	if b.file != nil {
+		return io.NewSectionReader(b.file, 0, b.size)
+	}
+	return bytes.NewReader(b.mem.Bytes())
+}
+
+// Close removes the temporary file, if any.
+func (b *bodyBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	err := os.Remove(b.file.Name())
+	b.file = nil
+	return err
+}
@@ -0,0 +1,256 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets, in seconds.
+var (
+	DataDurationBuckets    = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	SessionDurationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+)
+
+// Reasons a message is rejected at the end of DATA, used as metric labels.
+const (
+	RejectMaxSize    = "max_size"    // Message larger than Server.MaxSize
+	RejectLineLength = "line_length" // Text line longer than Server.MaxLineLength
+	RejectNetwork    = "network"     // Connection failed or timed out during DATA
+	RejectHandler    = "handler"     // Handler returned an error
+)
+
+// Metrics collects statistics from one or more servers and serves them in the
+// Prometheus text exposition format. It is safe for concurrent use.
+// The zero value is ready to use with the default buckets, and recording into
+// a nil *Metrics does nothing.
+type Metrics struct {
+	mu                sync.Mutex
+	connectionsActive int64
+	connectionsTotal  uint64
+	commands          map[[2]string]uint64 // verb, reply code
+	tlsHandshakes     map[[2]string]uint64 // version, cipher suite
+	tlsFailures       uint64
+	messagesAccepted  uint64
+	bytesAccepted     uint64
+	messagesRejected  map[string]uint64 // reason
+	bytesRejected     map[string]uint64 // reason
+	dataDuration      *histogram
+	sessionDuration   *histogram
+}
+
+// NewMetrics returns an empty set of metrics using the default buckets.
+func NewMetrics() *Metrics {
+	m := &Metrics{}
+	m.init()
+	return m
+}
+
+// init allocates the maps and histograms not yet created. Callers hold m.mu.
+func (m *Metrics) init() {
+	if m.commands == nil {
+		m.commands = make(map[[2]string]uint64)
+		m.tlsHandshakes = make(map[[2]string]uint64)
+		m.messagesRejected = make(map[string]uint64)
+		m.bytesRejected = make(map[string]uint64)
+		m.dataDuration = newHistogram(DataDurationBuckets)
+		m.sessionDuration = newHistogram(SessionDurationBuckets)
+	}
+}
+
+func (m *Metrics) connectionOpened() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connectionsActive++
+	m.connectionsTotal++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) connectionClosed(d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.init()
+	m.connectionsActive--
+	m.sessionDuration.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// Commands outside the known set are counted together to bound the number of series.
+var metricVerbs = map[string]bool{
+	"HELO": true, "EHLO": true, "MAIL": true, "RCPT": true, "DATA": true, "QUIT": true, "RSET": true,
+	"NOOP": true, "HELP": true, "VRFY": true, "EXPN": true, "STARTTLS": true, "AUTH": true,
+}
+
+func (m *Metrics) command(verb string, code string) {
+	if m == nil {
+		return
+	}
+	if !metricVerbs[verb] {
+		verb = "UNKNOWN"
+	}
+	m.mu.Lock()
+	m.init()
+	m.commands[[2]string{verb, code}]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) tlsHandshake(version uint16, cipherSuite uint16, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.init()
+	if err != nil {
+		m.tlsFailures++
+	} else {
+		m.tlsHandshakes[[2]string{tlsVersionName(version), tls.CipherSuiteName(cipherSuite)}]++
+	}
+	m.mu.Unlock()
+}
+
+// message records the outcome of DATA. An empty reason means the message was accepted.
+func (m *Metrics) message(bytes int, d time.Duration, reason string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.init()
+	if reason == "" {
+		m.messagesAccepted++
+		m.bytesAccepted += uint64(bytes)
+	} else {
+		m.messagesRejected[reason]++
+		m.bytesRejected[reason] += uint64(bytes)
+	}
+	m.dataDuration.observe(d.Seconds())
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, nil
+	}
+	m.mu.Lock()
+	m.init()
+	defer m.mu.Unlock()
+
+	var b strings.Builder
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("smtpd_connections_active", "gauge", "Number of open SMTP connections.")
+	fmt.Fprintf(&b, "smtpd_connections_active %d\n", m.connectionsActive)
+	metric("smtpd_connections_total", "counter", "Total number of SMTP connections accepted.")
+	fmt.Fprintf(&b, "smtpd_connections_total %d\n", m.connectionsTotal)
+
+	metric("smtpd_commands_total", "counter", "Total number of replies sent, by command verb and reply code.")
+	for _, k := range sortedPairs(m.commands) {
+		fmt.Fprintf(&b, "smtpd_commands_total{verb=%s,code=%s} %d\n", labelValue(k[0]), labelValue(k[1]), m.commands[k])
+	}
+
+	metric("smtpd_tls_handshakes_total", "counter", "Total number of successful TLS handshakes, by version and cipher suite.")
+	for _, k := range sortedPairs(m.tlsHandshakes) {
+		fmt.Fprintf(&b, "smtpd_tls_handshakes_total{version=%s,cipher=%s} %d\n", labelValue(k[0]), labelValue(k[1]), m.tlsHandshakes[k])
+	}
+	metric("smtpd_tls_handshake_failures_total", "counter", "Total number of failed TLS handshakes.")
+	fmt.Fprintf(&b, "smtpd_tls_handshake_failures_total %d\n", m.tlsFailures)
+
+	metric("smtpd_messages_accepted_total", "counter", "Total number of messages accepted.")
+	fmt.Fprintf(&b, "smtpd_messages_accepted_total %d\n", m.messagesAccepted)
+	metric("smtpd_message_bytes_accepted_total", "counter", "Total size of messages accepted, in bytes.")
+	fmt.Fprintf(&b, "smtpd_message_bytes_accepted_total %d\n", m.bytesAccepted)
+	metric("smtpd_messages_rejected_total", "counter", "Total number of messages rejected at the end of DATA, by reason.")
+	for _, k := range sortedKeys(m.messagesRejected) {
+		fmt.Fprintf(&b, "smtpd_messages_rejected_total{reason=%s} %d\n", labelValue(k), m.messagesRejected[k])
+	}
+	metric("smtpd_message_bytes_rejected_total", "counter", "Total size of messages rejected at the end of DATA, in bytes, by reason.")
+	for _, k := range sortedKeys(m.bytesRejected) {
+		fmt.Fprintf(&b, "smtpd_message_bytes_rejected_total{reason=%s} %d\n", labelValue(k), m.bytesRejected[k])
+	}
+
+	metric("smtpd_data_duration_seconds", "histogram", "Time taken to receive and handle DATA.")
+	m.dataDuration.write(&b, "smtpd_data_duration_seconds")
+	metric("smtpd_session_duration_seconds", "histogram", "Duration of SMTP sessions.")
+	m.sessionDuration.write(&b, "smtpd_session_duration_seconds")
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// histogram counts observations in cumulative buckets. Callers hold Metrics.mu.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(b *strings.Builder, name string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(b, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count %d\n", name, h.count)
+}
+
+// labelValue quotes and escapes a label value.
+func labelValue(v string) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	return `"` + strings.Replace(v, `"`, `\"`, -1) + `"`
+}
+
+func sortedPairs(m map[[2]string]uint64) [][2]string {
+	keys := make([][2]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	return keys
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,94 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	logger := newTestLogger()
+	metrics := NewMetrics()
+	server := &Server{
+		Logger:    logger,
+		MaxSize:   20,
+		Metrics:   metrics,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+	cmdCode(t, tlsConn, "EHLO host.example.com", 250)
+	cmdCode(t, tlsConn, "BOGUS", 500)
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, tlsConn, "DATA", 354)
+	cmdCode(t, tlsConn, "Test message.\r\n.", 250)
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, tlsConn, "DATA", 354)
+	cmdCode(t, tlsConn, "This test message is too long.\r\n.", 552)
+	cmdCode(t, tlsConn, "QUIT", 221)
+	tlsConn.Close()
+	<-logger.closed
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", ct)
+	}
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE smtpd_connections_total counter\nsmtpd_connections_total 1\n",
+		"smtpd_connections_active 0\n",
+		`smtpd_commands_total{verb="EHLO",code="250"} 2` + "\n",
+		`smtpd_commands_total{verb="STARTTLS",code="220"} 1` + "\n",
+		`smtpd_commands_total{verb="UNKNOWN",code="500"} 1` + "\n",
+		`smtpd_commands_total{verb="DATA",code="552"} 1` + "\n",
+		`smtpd_tls_handshakes_total{version="TLS 1.2",cipher="`,
+		"smtpd_tls_handshake_failures_total 0\n",
+		"smtpd_messages_accepted_total 1\n",
+		"smtpd_message_bytes_accepted_total 14\n",
+		`smtpd_messages_rejected_total{reason="max_size"} 1` + "\n",
+		"# TYPE smtpd_data_duration_seconds histogram\n",
+		`smtpd_data_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"smtpd_data_duration_seconds_count 2\n",
+		"smtpd_session_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestMetricsZeroValue(t *testing.T) {
+	logger := newTestLogger()
+	metrics := &Metrics{}
+	var b strings.Builder
+	if _, err := metrics.WriteTo(&b); err != nil || !strings.Contains(b.String(), "smtpd_session_duration_seconds_count 0\n") {
+		t.Errorf("WriteTo() wrote %q, %v", b.String(), err)
+	}
+
+	server := &Server{Logger: logger, Metrics: metrics}
+	sendMessage(t, server, "Test message.", 250)
+	<-logger.closed
+
+	b.Reset()
+	metrics.WriteTo(&b)
+	for _, want := range []string{
+		`smtpd_commands_total{verb="DATA",code="250"} 1` + "\n",
+		"smtpd_messages_accepted_total 1\n",
+		"smtpd_session_duration_seconds_count 1\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("metrics do not contain %q:\n%s", want, b.String())
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package smtpd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MessageParser parses a message as it streams in, typically from the body a
+// Handler is given. The server does not run it itself: a Handler calls Parse
+// on its body and returns the resulting error. The header block is parsed
+// first and passed to Header, whose error rejects the message before the body
+// is read; the server replies with it if it is an *Error. Each part that is
+// not a multipart is then passed to Part with its decoded content, which is
+// read straight from the message, so attachments are never held in memory
+// whole.
+type MessageParser struct {
+	Header        func(header textproto.MIMEHeader) error              // Called with the message header before the body is read
+	Part          func(part *MessagePart) error                        // Called for each leaf part, in order
+	CharsetReader func(charset string, r io.Reader) (io.Reader, error) // Converts text in other charsets than US-ASCII, UTF-8 and ISO-8859-1 to UTF-8
+}
+
+// MessagePart is a leaf MIME part of a message. A message that is not
+// multipart has a single part, sharing the message header.
+type MessagePart struct {
+	Header    textproto.MIMEHeader
+	Section   string            // IMAP style part number, e.g. "1.2"; "1" for a message that is not multipart
+	MediaType string            // Lower case, "text/plain" if absent or invalid
+	Params    map[string]string // Content-Type parameters
+	Filename  string            // From Content-Disposition, or the Content-Type name parameter
+	Charset   string            // Charset of the Body, "utf-8" once converted
+	Body      io.Reader         // Content with the transfer encoding removed; text is converted to UTF-8 when the charset is known
+}
+
+// errMalformedHeader is returned for a message whose header cannot be parsed.
+var errMalformedHeader = &Error{Code: 550, EnhancedCode: "5.6.0", Message: "Malformed message header"}
+
+// Parse reads the message from r to the end, calling the hooks. It stops at
+// the first error returned by a hook.
+func (p *MessageParser) Parse(r io.Reader) error {
+	br := bufio.NewReader(r)
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		if _, ok := err.(textproto.ProtocolError); ok {
+			return errMalformedHeader
+		}
+		return err
+	}
+	if p.Header != nil {
+		if err := p.Header(header); err != nil {
+			return err
+		}
+	}
+	if err := p.walk(header, br, ""); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, br)
+	return err
+}
+
+// Walk a part, descending into multiparts.
+func (p *MessageParser) walk(header textproto.MIMEHeader, body io.Reader, section string) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		r := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			part, err := r.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := p.walk(part.Header, part, subSection(section, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if p.Part == nil {
+		return nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	part := &MessagePart{
+		Header:    header,
+		Section:   subSection(section, 1),
+		MediaType: mediaType,
+		Params:    params,
+		Body:      body,
+	}
+	if section != "" {
+		part.Section = section
+	}
+	if _, dparams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil {
+		part.Filename = dparams["filename"]
+	}
+	if part.Filename == "" {
+		part.Filename = params["name"]
+	}
+	if strings.HasPrefix(mediaType, "text/") {
+		if part.Body, part.Charset, err = p.decodeCharset(params["charset"], body); err != nil {
+			return err
+		}
+	}
+	return p.Part(part)
+}
+
+// Return the number of the i'th child of a section.
+func subSection(section string, i int) string {
+	if section == "" {
+		return strconv.Itoa(i)
+	}
+	return section + "." + strconv.Itoa(i)
+}
+
+// Convert text to UTF-8 if its charset is known, returning the resulting charset.
+func (p *MessageParser) decodeCharset(charset string, r io.Reader) (io.Reader, string, error) {
+	switch strings.ToLower(charset) {
+	case "", "us-ascii", "ascii", "utf-8", "utf8":
+		return r, "utf-8", nil
+	case "iso-8859-1", "latin1", "latin-1":
+		return &latin1Reader{r: r}, "utf-8", nil
+	}
+	if p.CharsetReader == nil {
+		return r, strings.ToLower(charset), nil
+	}
+	cr, err := p.CharsetReader(strings.ToLower(charset), r)
+	if err != nil {
+		return nil, "", err
+	}
+	return cr, "utf-8", nil
+}
+
+// latin1Reader converts ISO-8859-1 to UTF-8.
+type latin1Reader struct {
+	r   io.Reader
+	buf []byte // Converted bytes not yet returned
+	err error  // Error of r, returned once buf is empty
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	if len(l.buf) == 0 {
+		if l.err != nil {
+			return 0, l.err
+		}
+		in := make([]byte, len(p)/2+1)
+		n, err := l.r.Read(in)
+		for _, b := range in[:n] {
+			l.buf = append(l.buf, string(rune(b))...)
+		}
+		l.err = err
+		if n == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+// DecodeHeader returns the value of a header field with RFC 2047 encoded
+// words decoded, using the parser's CharsetReader for unknown charsets.
+func (p *MessageParser) DecodeHeader(value string) string {
+	dec := &mime.WordDecoder{CharsetReader: func(charset string, r io.Reader) (io.Reader, error) {
+		cr, cs, err := p.decodeCharset(charset, r)
+		if err == nil && cs != "utf-8" {
+			err = textproto.ProtocolError("unknown charset " + charset)
+		}
+		return cr, err
+	}}
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil || !utf8.ValidString(decoded) {
+		return value
+	}
+	return decoded
+}
@@ -0,0 +1,123 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestMessageParser(t *testing.T) {
+	type part struct {
+		section, mediaType, filename, charset, body string
+	}
+	var parts []part
+	p := &MessageParser{
+		Part: func(mp *MessagePart) error {
+			b, err := ioutil.ReadAll(mp.Body)
+			parts = append(parts, part{mp.Section, mp.MediaType, mp.Filename, mp.Charset, string(b)})
+			return err
+		},
+		CharsetReader: func(charset string, r io.Reader) (io.Reader, error) {
+			if charset != "x-upper" {
+				return nil, errors.New("unknown charset")
+			}
+			b, err := ioutil.ReadAll(r)
+			return strings.NewReader(strings.ToLower(string(b))), err
+		},
+	}
+	msg := strings.Replace(webhookTestMessage, "--outer--\n", "--outer\n"+
+		"Content-Type: text/plain; charset=iso-8859-1\n"+
+		"Content-Transfer-Encoding: base64\n\n"+
+		"Q2Fm6Q==\n"+
+		"--outer\n"+
+		"Content-Type: text/plain; charset=x-upper\n\n"+
+		"SHOUT\n"+
+		"--outer--\n", 1)
+	if err := p.Parse(strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	want := []part{
+		{"1.1", "text/plain", "", "utf-8", "Café au lait."},
+		{"1.2", "text/html", "", "utf-8", "<p>Café au lait.</p>"},
+		{"2", "application/octet-stream", "data.bin", "", "\x00\x01\x02\x03\x04"},
+		{"3", "text/plain", "", "utf-8", "Café"},
+		{"4", "text/plain", "", "utf-8", "shout"},
+	}
+	if len(parts) != len(want) {
+		t.Fatalf("parsed %q, want %q", parts, want)
+	}
+	for i := range want {
+		if parts[i] != want[i] {
+			t.Errorf("part %d is %q, want %q", i, parts[i], want[i])
+		}
+	}
+
+	parts = nil
+	if err := p.Parse(strings.NewReader("Subject: Plain\n\nJust text.\n")); err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 1 || parts[0] != (part{"1", "text/plain", "", "utf-8", "Just text.\n"}) {
+		t.Errorf("parsed %q", parts)
+	}
+	if got := p.DecodeHeader("=?iso-8859-1?q?Caf=E9?= =?x-upper?q?_BAR?="); got != "Café bar" {
+		t.Errorf("decoded header is %q", got)
+	}
+}
+
+func TestMessageParserHeaderHook(t *testing.T) {
+	var bodyRead bool
+	server := &Server{
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			p := &MessageParser{
+				Header: func(header textproto.MIMEHeader) error {
+					if header.Get("X-Spam") != "" {
+						return &Error{Code: 550, EnhancedCode: "5.7.1", Message: "Spam rejected"}
+					}
+					return nil
+				},
+				Part: func(part *MessagePart) error {
+					bodyRead = true
+					return nil
+				},
+			}
+			return p.Parse(body)
+		},
+	}
+	sendMessage(t, server, "X-Spam: yes\r\n\r\n"+strings.Repeat("Body line.\r\n", 1000), 550)
+	if bodyRead {
+		t.Error("body parsed after the header hook rejected the message")
+	}
+	sendMessage(t, server, "Subject: Ham\r\n\r\nBody line.", 250)
+	if !bodyRead {
+		t.Error("body not parsed")
+	}
+	sendMessage(t, server, "Not a header\r\n\r\nBody line.", 550)
+}
+
+// oneErrReader returns its data together with err, then io.EOF.
+type oneErrReader struct {
+	data string
+	err  error
+}
+
+func (r *oneErrReader) Read(p []byte) (int, error) {
+	if r.err == nil {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	err := r.err
+	r.data, r.err = "", nil
+	return n, err
+}
+
+func TestLatin1ReaderError(t *testing.T) {
+	broken := errors.New("connection reset")
+	b, err := ioutil.ReadAll(&latin1Reader{r: &oneErrReader{data: "Caf\xe9", err: broken}})
+	if string(b) != "Café" || err != broken {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
@@ -0,0 +1,238 @@
+package smtpd
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RcptVerifier function called on RCPT in place of HandlerRcpt. Return nil to
+// accept the recipient. An *Error is sent as the reply, e.g. 550 5.1.1 for an
+// unknown user, 452 4.2.2 for a full mailbox or 554 5.7.1 for a relay denied;
+// other errors are replied to with 451 4.3.0 so the client tries again later.
+type RcptVerifier func(remoteAddr net.Addr, from string, to string) error
+
+// Errors returned by RecipientMap.
+var (
+	errUnknownRecipient = &Error{Code: 550, EnhancedCode: "5.1.1", Message: "Recipient address rejected: user unknown"}
+	errRelayDenied      = &Error{Code: 554, EnhancedCode: "5.7.1", Message: "Relay access denied"}
+	errAliasLoop        = &Error{Code: 554, EnhancedCode: "5.4.6", Message: "Alias loop detected"}
+)
+
+// Maximum depth of aliases expanded by RecipientMap.Resolve.
+const maxAliasDepth = 10
+
+// RecipientMap is a table of local recipients and aliases. Its Verify method
+// is an RcptVerifier.
+//
+// Each key of Entries is an address, mapped to the addresses it is delivered
+// to, or to none for a mailbox. Entries are looked up by the recipient, then
+// by the recipient without its subaddress (the part of the local part after
+// Separator), then by a catch-all key "@domain". The domain of a key may be a
+// wildcard: "*.example.com" matches any subdomain of example.com, "*" any
+// local domain, e.g. in "postmaster@*". Domains are compared without case,
+// and local parts too unless CaseSensitive is set. Entries and CaseSensitive
+// must not be modified once the map is in use.
+//
+// Recipients in a domain of any key must be found in the map. Recipients in
+// RelayDomains are accepted without lookup, and those in other domains only
+// from clients Relay allows. The bare recipient "postmaster" is always
+// accepted (RFC 5321 section 4.5.1) and resolved with the "postmaster@*"
+// entry.
+type RecipientMap struct {
+	Entries       map[string][]string
+	Separator     string                         // Subaddress separator, e.g. "+" for "user+tag@example.com", none if empty
+	CaseSensitive bool                           // Compare local parts case sensitively, as allowed by RFC 5321
+	RelayDomains  []string                       // Domains recipients are accepted for without lookup, e.g. those of a backup MX
+	Relay         func(remoteAddr net.Addr) bool // Reports clients allowed to relay to any domain, e.g. authenticated ones
+
+	once    sync.Once
+	entries map[string][]string // Entries by normalized key
+	domains map[string]bool     // Domains of the keys of Entries
+}
+
+// LoadRecipientMap reads a RecipientMap from a file in the format of the
+// Postfix virtual table: each line holds a key and the addresses it is
+// delivered to, separated by white space or commas. Empty lines and lines
+// starting with "#" are ignored. Domains are folded to lower case, and local
+// parts left for the map to compare according to CaseSensitive.
+func LoadRecipientMap(name string) (*RecipientMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := &RecipientMap{Entries: make(map[string][]string)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		for i, field := range fields {
+			if j := strings.LastIndex(field, "@"); j >= 0 {
+				fields[i] = field[:j] + strings.ToLower(field[j:])
+			}
+		}
+		m.Entries[fields[0]] = append(m.Entries[fields[0]], fields[1:]...)
+	}
+	return m, scanner.Err()
+}
+
+// Verify accepts recipients found in the map or allowed to be relayed.
+func (m *RecipientMap) Verify(remoteAddr net.Addr, from string, to string) error {
+	if strings.EqualFold(to, "postmaster") {
+		return nil
+	}
+	addr := m.normalize(to)
+	domain := addr[strings.LastIndex(addr, "@")+1:]
+	if m.local(domain) {
+		if _, _, ok := m.lookup(addr); !ok {
+			return errUnknownRecipient
+		}
+		return nil
+	}
+	for _, d := range m.RelayDomains {
+		if strings.EqualFold(d, domain) {
+			return nil
+		}
+	}
+	if m.Relay != nil && m.Relay(remoteAddr) {
+		return nil
+	}
+	return errRelayDenied
+}
+
+// Resolve returns the mailboxes a local recipient is delivered to, expanding
+// aliases.
+func (m *RecipientMap) Resolve(rcpt string) ([]string, error) {
+	var mailboxes []string
+	seen := make(map[string]bool)
+	add := func(mailbox string) {
+		if !seen[mailbox] {
+			seen[mailbox] = true
+			mailboxes = append(mailboxes, mailbox)
+		}
+	}
+	var expand func(addr string, depth int) error
+	expand = func(addr string, depth int) error {
+		if depth > maxAliasDepth {
+			return errAliasLoop
+		}
+		key, targets, ok := m.lookup(m.normalize(addr))
+		if !ok && depth == 0 {
+			return errUnknownRecipient
+		}
+		if !ok {
+			// Aliases may point outside the map.
+			add(m.normalize(addr))
+			return nil
+		}
+		if len(targets) == 0 {
+			add(key)
+			return nil
+		}
+		for _, target := range targets {
+			if m.normalize(target) == key {
+				// An alias keeping a copy in its own mailbox.
+				add(key)
+			} else if err := expand(target, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := expand(rcpt, 0); err != nil {
+		return nil, err
+	}
+	return mailboxes, nil
+}
+
+// Fold the case of an address, leaving the local part unless CaseSensitive.
+func (m *RecipientMap) normalize(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr
+	}
+	local := addr[:i]
+	if !m.CaseSensitive {
+		local = strings.ToLower(local)
+	}
+	return local + "@" + strings.ToLower(addr[i+1:])
+}
+
+// Index the entries by normalized key on first use.
+func (m *RecipientMap) init() {
+	m.once.Do(func() {
+		m.entries = make(map[string][]string, len(m.Entries))
+		m.domains = make(map[string]bool)
+		for key, targets := range m.Entries {
+			key = m.normalize(key)
+			m.entries[key] = append(m.entries[key], targets...)
+			m.domains[key[strings.LastIndex(key, "@")+1:]] = true
+		}
+	})
+}
+
+// Return whether the map holds keys for the domain.
+func (m *RecipientMap) local(domain string) bool {
+	m.init()
+	for _, d := range wildcardDomains(domain) {
+		if m.domains[d] && d != "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the domain followed by the wildcards matching it, most specific first.
+func wildcardDomains(domain string) []string {
+	domains := []string{domain}
+	for d := domain; strings.Contains(d, "."); {
+		d = d[strings.Index(d, ".")+1:]
+		domains = append(domains, "*."+d)
+	}
+	return append(domains, "*")
+}
+
+// Look up a normalized address, returning the address of the entry found,
+// without any subaddress, and its targets.
+func (m *RecipientMap) lookup(addr string) (string, []string, bool) {
+	m.init()
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		if strings.EqualFold(addr, "postmaster") {
+			targets, ok := m.entries["postmaster@*"]
+			return "postmaster", targets, ok
+		}
+		return "", nil, false
+	}
+	local, domain := addr[:i], addr[i+1:]
+	locals := []string{local}
+	if j := strings.Index(local, m.Separator); m.Separator != "" && j > 0 {
+		locals = append(locals, local[:j])
+	}
+	domains := wildcardDomains(domain)
+	for _, l := range locals {
+		for _, d := range domains {
+			if targets, ok := m.entries[l+"@"+d]; ok {
+				return l + "@" + domain, targets, true
+			}
+		}
+	}
+	for _, d := range domains {
+		if targets, ok := m.entries["@"+d]; ok {
+			return addr, targets, true
+		}
+	}
+	return "", nil, false
+}
@@ -0,0 +1,152 @@
+package smtpd
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecipientMap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recipients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "virtual")
+	table := `# Mailboxes
+alice@example.com
+Bob@Example.com
+postmaster@*         alice@example.com
+@example.org         alice@example.com
+
+# Aliases
+team@example.com     alice@example.com, bob@example.com, carol@example.net
+all@example.com      team@example.com bob@example.com
+self@example.com     self@example.com alice@example.com
+loop@example.com     loop2@example.com
+loop2@example.com    loop@example.com
+*@*.example.com
+`
+	if err := ioutil.WriteFile(name, []byte(table), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := LoadRecipientMap(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Separator = "+"
+	m.RelayDomains = []string{"backup.example.net"}
+	m.Relay = func(remoteAddr net.Addr) bool {
+		return remoteAddr.String() == "internal"
+	}
+
+	tests := []struct {
+		to   string
+		addr string
+		want string
+	}{
+		{"alice@example.com", "", ""},
+		{"ALICE+tag@EXAMPLE.com", "", ""},
+		{"bob@example.com", "", ""},
+		{"carol@example.com", "", "550 5.1.1 "},
+		{"postmaster@example.com", "", ""},
+		{"Postmaster", "", ""},
+		{"alice", "", "554 5.7.1 "},
+		{"anyone@example.org", "", ""},
+		{"*@sub.example.com", "", ""},
+		{"anyone@sub.example.com", "", "550 5.1.1 "},
+		{"carol@backup.example.net", "", ""},
+		{"carol@example.net", "", "554 5.7.1 "},
+		{"carol@example.net", "internal", ""},
+	}
+	for _, tt := range tests {
+		err := m.Verify(testAddr(tt.addr), "sender@example.net", tt.to)
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)) {
+			t.Errorf("Verify(%q) = %v, want %q", tt.to, err, tt.want)
+		}
+	}
+
+	resolved := []struct {
+		rcpt string
+		want []string
+		err  string
+	}{
+		{"Alice+tag@example.com", []string{"alice@example.com"}, ""},
+		{"all@example.com", []string{"alice@example.com", "bob@example.com", "carol@example.net"}, ""},
+		{"self@example.com", []string{"self@example.com", "alice@example.com"}, ""},
+		{"postmaster@example.org", []string{"alice@example.com"}, ""},
+		{"postmaster", []string{"alice@example.com"}, ""},
+		{"loop@example.com", nil, "554 5.4.6 "},
+		{"nobody@example.com", nil, "550 5.1.1 "},
+	}
+	for _, tt := range resolved {
+		got, err := m.Resolve(tt.rcpt)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("Resolve(%q) error %v, want %q", tt.rcpt, err, tt.err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Resolve(%q) = %q, want %q", tt.rcpt, got, tt.want)
+		}
+	}
+
+	// Loaded local parts keep their case for CaseSensitive maps.
+	m, err = LoadRecipientMap(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.CaseSensitive = true
+	for to, want := range map[string]bool{"Bob@example.com": true, "Bob@EXAMPLE.COM": true, "bob@example.com": false, "Alice@example.com": false} {
+		if err := m.Verify(nil, "sender@example.net", to); (err == nil) != want {
+			t.Errorf("case sensitive Verify(%q) = %v", to, err)
+		}
+	}
+}
+
+// net.Addr with a fixed string.
+type testAddr string
+
+func (a testAddr) Network() string { return "test" }
+func (a testAddr) String() string  { return string(a) }
+
+func TestVerifyRcpt(t *testing.T) {
+	server := &Server{
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			t.Error("HandlerRcpt called with VerifyRcpt set")
+			return false
+		},
+		VerifyRcpt: func(remoteAddr net.Addr, from string, to string) error {
+			switch to {
+			case "full@example.com":
+				return &Error{Code: 452, EnhancedCode: "4.2.2", Message: "Mailbox full"}
+			case "broken@example.com":
+				return errors.New("database unavailable")
+			}
+			return nil
+		},
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	if msg := cmdCode(t, conn, "RCPT TO:<full@example.com>", 452); msg != "4.2.2 Mailbox full" {
+		t.Errorf("rejected with %q", msg)
+	}
+	cmdCode(t, conn, "RCPT TO:<broken@example.com>", 451)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestVerifyRcptPostmaster(t *testing.T) {
+	server := &Server{VerifyRcpt: (&RecipientMap{Entries: map[string][]string{"alice@example.com": nil}}).Verify}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<postmaster>", 250)
+	cmdCode(t, conn, "RCPT TO:<bob@example.com>", 550)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
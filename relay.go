@@ -0,0 +1,400 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// enhancedCodeRE matches the enhanced status code at the start of a reply's text.
+var enhancedCodeRE = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(\s|$)`)
+
+var errNoMailHost = &Error{Code: 550, EnhancedCode: "5.1.2", Message: "no MX or address for domain"}
+
+// RelayTLSPolicy says when Relay uses STARTTLS.
+type RelayTLSPolicy int
+
+// STARTTLS policies.
+const (
+	RelayTLSOpportunistic RelayTLSPolicy = iota // Use STARTTLS when the server offers it
+	RelayTLSRequired                            // Do not deliver to servers not offering STARTTLS
+	RelayTLSDisabled                            // Never use STARTTLS
+)
+
+// Relay forwards messages to an upstream server, or to the MX hosts of each
+// recipient's domain. Its Deliver method is a Handler.
+//
+// The message is accepted once every recipient is delivered to. If none is,
+// Deliver returns the error of the first recipient, temporary if any failure
+// was, so that the client keeps responsibility for the message. Otherwise the
+// message is accepted and a DSN listing the recipients that failed, with the
+// header of the message, is sent to the sender unless the sender is null.
+//
+// Connections are kept open for reuse by later messages for IdleTimeout.
+type Relay struct {
+	Upstream    string                                       // host:port of a smart host relaying every message; MX hosts are used if empty
+	LookupMX    func(name string) ([]*net.MX, error)         // MX lookup, defaults to net.LookupMX
+	Dial        func(network, addr string) (net.Conn, error) // Opens connections, e.g. to local servers in tests; defaults to a net.Dialer with Timeout
+	Hostname    string                                       // Sent with EHLO and shown in bounces, defaults to "localhost"
+	TLS         RelayTLSPolicy                               // When to use STARTTLS
+	TLSConfig   *tls.Config                                  // Used for STARTTLS; if nil, certificates are only verified when TLS is RelayTLSRequired
+	Auth        smtp.Auth                                    // Authenticates to servers offering AUTH, which then must be offered
+	Timeout     time.Duration                                // Maximum time for connecting and for each message, defaults to 5 minutes
+	IdleTimeout time.Duration                                // How long connections are kept for reuse, defaults to 30 seconds; negative disables reuse
+	Logger      Logger                                       // Receives delivery results, nothing is logged if nil
+
+	mu   sync.Mutex
+	idle map[string][]*relayConn
+}
+
+// RelayFailure is a recipient Relay could not deliver to.
+type RelayFailure struct {
+	Rcpt      string
+	RemoteMTA string // Host that rejected the recipient, empty if none replied
+	Err       *Error // Reply from RemoteMTA, or a local error with a 4xx code for network failures
+}
+
+// relayConn is a connection to an SMTP server.
+type relayConn struct {
+	host   string // Host name, for RelayFailure
+	conn   net.Conn
+	client *smtp.Client
+	used   time.Time
+}
+
+// Deliver relays the message to every recipient.
+func (r *Relay) Deliver(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	return r.DeliverContext(context.Background(), remoteAddr, from, to, body)
+}
+
+// DeliverContext relays the message to every recipient. It is a
+// HandlerContext: bounces honor the RET and ENVID parameters given with MAIL
+// (RFC 3461), found in the session of ctx.
+func (r *Relay) DeliverContext(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	msg, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	failures := r.Send(from, to, msg)
+	if len(failures) == 0 {
+		return nil
+	}
+	if len(failures) == len(to) {
+		for _, f := range failures {
+			if f.Err.Code < 500 {
+				return f.Err
+			}
+		}
+		return failures[0].Err
+	}
+	if from != "" {
+		var params map[string]string
+		if info := SessionFromContext(ctx); info != nil {
+			params = info.MailParams
+		}
+		if failures := r.Send("", []string{from}, r.bounce(from, params, failures, msg)); len(failures) > 0 {
+			r.log(LogError, "bounce failed", "to", from, "error", failures[0].Err)
+		}
+	}
+	return nil
+}
+
+// Send delivers msg, with LF or CRLF line endings, to the recipients, and
+// returns those it could not deliver to.
+func (r *Relay) Send(from string, to []string, msg []byte) []RelayFailure {
+	if r.Upstream != "" {
+		return r.sendHost([]string{r.Upstream}, from, to, msg)
+	}
+
+	// Deliver to each domain in turn.
+	var domains []string
+	rcpts := make(map[string][]string)
+	for _, rcpt := range to {
+		domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+		if rcpts[domain] == nil {
+			domains = append(domains, domain)
+		}
+		rcpts[domain] = append(rcpts[domain], rcpt)
+	}
+	var failures []RelayFailure
+	for _, domain := range domains {
+		addrs, err := r.lookupMX(domain)
+		if err != nil {
+			failures = append(failures, relayFailures(rcpts[domain], "", err)...)
+			continue
+		}
+		failures = append(failures, r.sendHost(addrs, from, rcpts[domain], msg)...)
+	}
+	return failures
+}
+
+// Return the addresses of the MX hosts of a domain, most preferred first.
+func (r *Relay) lookupMX(domain string) ([]string, error) {
+	lookupMX := r.LookupMX
+	if lookupMX == nil {
+		lookupMX = net.LookupMX
+	}
+	mxs, err := lookupMX(domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		// RFC 5321 section 5.1: without MX records the domain itself is used.
+		mxs, err = []*net.MX{{Host: domain}}, nil
+	}
+	if err != nil {
+		return nil, &Error{Code: 451, EnhancedCode: "4.4.3", Message: "MX lookup failed: " + err.Error()}
+	}
+	// RFC 7505: a single MX of "." means the domain accepts no mail.
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, &Error{Code: 556, EnhancedCode: "5.1.10", Message: "Recipient domain does not accept mail"}
+	}
+	if len(mxs) == 0 {
+		return nil, errNoMailHost
+	}
+	sort.SliceStable(mxs, func(i, j int) bool { return mxs[i].Pref < mxs[j].Pref })
+	addrs := make([]string, len(mxs))
+	for i, mx := range mxs {
+		addrs[i] = net.JoinHostPort(strings.TrimSuffix(mx.Host, "."), "25")
+	}
+	return addrs, nil
+}
+
+// Deliver to the first of addrs that gives an answer about the recipients.
+func (r *Relay) sendHost(addrs []string, from string, to []string, msg []byte) []RelayFailure {
+	var host string
+	var err error
+	for _, addr := range addrs {
+		var c *relayConn
+		if c, err = r.conn(addr); err != nil {
+			host = ""
+			r.log(LogWarn, "relay connection failed", "addr", addr, "error", err)
+			continue
+		}
+		host = c.host
+		var failures []RelayFailure
+		if failures, err = r.transaction(c, from, to, msg); err == nil {
+			r.release(addr, c)
+			r.log(LogInfo, "message relayed", "addr", addr, "from", from, "rcpts", len(to), "failed", len(failures))
+			return failures
+		}
+		c.client.Close()
+		r.log(LogWarn, "relay failed", "addr", addr, "from", from, "error", err)
+		if tpErr, ok := err.(*textproto.Error); ok && tpErr.Code >= 500 {
+			break
+		}
+	}
+	return relayFailures(to, host, err)
+}
+
+// Send a message over c, returning the recipients it was not accepted for,
+// or an error if the transaction failed as a whole.
+func (r *Relay) transaction(c *relayConn, from string, to []string, msg []byte) ([]RelayFailure, error) {
+	c.conn.SetDeadline(time.Now().Add(r.timeout()))
+	if err := c.client.Mail(from); err != nil {
+		return nil, err
+	}
+	var failures []RelayFailure
+	var accepted []string
+	for _, rcpt := range to {
+		err := c.client.Rcpt(rcpt)
+		if _, ok := err.(*textproto.Error); ok {
+			failures = append(failures, relayFailures([]string{rcpt}, c.host, err)...)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		return failures, c.client.Reset()
+	}
+
+	w, err := c.client.Data()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bytes.Replace(msg, []byte("\r\n"), []byte("\n"), -1)); err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if _, ok := err.(*textproto.Error); ok {
+		// The message was rejected after the recipients were accepted.
+		return append(failures, relayFailures(accepted, c.host, err)...), nil
+	}
+	return failures, err
+}
+
+// Return an idle connection to addr, or open a new one.
+func (r *Relay) conn(addr string) (*relayConn, error) {
+	r.mu.Lock()
+	for len(r.idle[addr]) > 0 {
+		conns := r.idle[addr]
+		c := conns[len(conns)-1]
+		r.idle[addr] = conns[:len(conns)-1]
+		r.mu.Unlock()
+		if time.Since(c.used) < r.idleTimeout() {
+			c.conn.SetDeadline(time.Now().Add(r.timeout()))
+			if c.client.Reset() == nil {
+				return c, nil
+			}
+		}
+		c.client.Close()
+		r.mu.Lock()
+	}
+	r.mu.Unlock()
+	return r.dial(addr)
+}
+
+// Keep a connection for reuse, or close it.
+func (r *Relay) release(addr string, c *relayConn) {
+	if r.IdleTimeout < 0 {
+		c.client.Quit()
+		return
+	}
+	c.used = time.Now()
+	r.mu.Lock()
+	if r.idle == nil {
+		r.idle = make(map[string][]*relayConn)
+	}
+	r.idle[addr] = append(r.idle[addr], c)
+	r.mu.Unlock()
+}
+
+// Close closes the connections kept for reuse.
+func (r *Relay) Close() error {
+	r.mu.Lock()
+	idle := r.idle
+	r.idle = nil
+	r.mu.Unlock()
+	for _, conns := range idle {
+		for _, c := range conns {
+			c.conn.SetDeadline(time.Now().Add(r.timeout()))
+			c.client.Quit()
+		}
+	}
+	return nil
+}
+
+// Connect to addr, greet the server and apply the TLS and AUTH settings.
+func (r *Relay) dial(addr string) (*relayConn, error) {
+	dial := r.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: r.timeout()}).Dial
+	}
+	conn, err := dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(r.timeout()))
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	c := &relayConn{host: host, conn: conn}
+	if c.client, err = smtp.NewClient(conn, host); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := r.setup(c); err != nil {
+		c.client.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (r *Relay) setup(c *relayConn) error {
+	hostname := r.Hostname
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if err := c.client.Hello(hostname); err != nil {
+		return err
+	}
+
+	if ok, _ := c.client.Extension("STARTTLS"); ok && r.TLS != RelayTLSDisabled {
+		config := &tls.Config{InsecureSkipVerify: r.TLS != RelayTLSRequired}
+		if r.TLSConfig != nil {
+			config = r.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = c.host
+		}
+		if err := c.client.StartTLS(config); err != nil {
+			return err
+		}
+	} else if r.TLS == RelayTLSRequired {
+		return &Error{Code: 454, EnhancedCode: "4.7.10", Message: "STARTTLS not offered by " + c.host}
+	}
+
+	if r.Auth != nil {
+		if ok, _ := c.client.Extension("AUTH"); !ok {
+			return &Error{Code: 454, EnhancedCode: "4.7.0", Message: "AUTH not offered by " + c.host}
+		}
+		if err := c.client.Auth(r.Auth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Relay) timeout() time.Duration {
+	if r.Timeout > 0 {
+		return r.Timeout
+	}
+	return 5 * time.Minute
+}
+
+func (r *Relay) idleTimeout() time.Duration {
+	if r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return 30 * time.Second
+}
+
+// Build a delivery status notification for the failed recipients of a message.
+func (r *Relay) bounce(to string, params map[string]string, failures []RelayFailure, msg []byte) []byte {
+	dsn := newDSN(r.Hostname, to, params, msg)
+	for _, f := range failures {
+		dsn.Recipients = append(dsn.Recipients, f.DSNRecipient())
+	}
+	return dsn.Bytes()
+}
+
+// Return a failure for each recipient, converting err to an *Error. A nil err
+// means there was no host to try.
+func relayFailures(rcpts []string, host string, err error) []RelayFailure {
+	var serr *Error
+	switch err := err.(type) {
+	case nil:
+		serr = errNoMailHost
+	case *Error:
+		serr = err
+	case *textproto.Error:
+		serr = &Error{Code: err.Code, Message: err.Msg}
+		if m := enhancedCodeRE.FindStringSubmatch(err.Msg); m != nil {
+			serr.EnhancedCode, serr.Message = m[1], strings.TrimSpace(err.Msg[len(m[1]):])
+		}
+	default:
+		serr = &Error{Code: 451, EnhancedCode: "4.4.1", Message: err.Error()}
+	}
+	failures := make([]RelayFailure, len(rcpts))
+	for i, rcpt := range rcpts {
+		failures[i] = RelayFailure{Rcpt: rcpt, RemoteMTA: host, Err: serr}
+	}
+	return failures
+}
+
+func (r *Relay) log(level LogLevel, msg string, keyvals ...interface{}) {
+	if r.Logger != nil {
+		r.Logger.Log(level, msg, keyvals...)
+	}
+}
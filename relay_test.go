@@ -0,0 +1,176 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A message received by a relayServer.
+type relayedMessage struct {
+	session string
+	tls     bool
+	from    string
+	to      []string
+	data    string
+}
+
+// Server standing in for a remote MX.
+type relayServer struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	messages []relayedMessage
+}
+
+func startRelayServer(t *testing.T, tlsConfig *tls.Config) *relayServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &relayServer{ln: ln}
+	srv := &Server{
+		Hostname:  "mx.example.com",
+		TLSConfig: tlsConfig,
+		HandlerRcpt: func(remoteAddr net.Addr, from string, to string) bool {
+			return !strings.HasPrefix(to, "unknown@")
+		},
+		HandlerContext: func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			info := SessionFromContext(ctx)
+			rs.mu.Lock()
+			rs.messages = append(rs.messages, relayedMessage{info.ID, info.TLS != nil, from, to, string(b)})
+			rs.mu.Unlock()
+			return nil
+		},
+	}
+	go srv.Serve(ln)
+	return rs
+}
+
+func (rs *relayServer) received() []relayedMessage {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return append([]relayedMessage(nil), rs.messages...)
+}
+
+func TestRelay(t *testing.T) {
+	mx1 := startRelayServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer mx1.ln.Close()
+	mx2 := startRelayServer(t, nil)
+	defer mx2.ln.Close()
+	mx3 := startRelayServer(t, nil)
+	defer mx3.ln.Close()
+
+	hosts := map[string]string{
+		"mx1.example.com:25": mx1.ln.Addr().String(),
+		"mx.example.org:25":  mx2.ln.Addr().String(),
+		"mx.example.net:25":  mx3.ln.Addr().String(),
+	}
+	r := &Relay{
+		Hostname: "relay.example.com",
+		LookupMX: func(name string) ([]*net.MX, error) {
+			switch name {
+			case "example.com":
+				return []*net.MX{{Host: "mx1.example.com.", Pref: 10}, {Host: "down.example.com.", Pref: 5}}, nil
+			case "example.org":
+				return []*net.MX{{Host: "mx.example.org.", Pref: 10}}, nil
+			case "example.net":
+				return []*net.MX{{Host: "mx.example.net.", Pref: 10}}, nil
+			case "nullmx.example.com":
+				return []*net.MX{{Host: ".", Pref: 0}}, nil
+			case "empty.example.com":
+				return nil, nil
+			}
+			return nil, errors.New("server misbehaving")
+		},
+		Dial: func(network, addr string) (net.Conn, error) {
+			if hosts[addr] == "" {
+				return nil, errors.New("connection refused")
+			}
+			return net.Dial(network, hosts[addr])
+		},
+	}
+	defer r.Close()
+
+	msg := "Subject: Test\n\nHello.\n"
+	to := []string{"alice@example.com", "unknown@example.com", "bob@EXAMPLE.org"}
+	if err := r.Deliver(nil, "sender@example.net", to, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Deliver(nil, "sender@example.net", []string{"carol@example.com"}, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Recipients are grouped by domain, and connections reused.
+	got := mx1.received()
+	if len(got) != 2 || strings.Join(got[0].to, ",") != "alice@example.com" || got[0].data != msg || !got[0].tls {
+		t.Fatalf("mx1 received %+v", got)
+	}
+	if got[1].session != got[0].session {
+		t.Error("connection to mx1 not reused")
+	}
+	if got := mx2.received(); len(got) != 1 || strings.Join(got[0].to, ",") != "bob@EXAMPLE.org" || got[0].tls {
+		t.Errorf("mx2 received %+v", got)
+	}
+
+	// The failed recipient is bounced to the sender.
+	got = mx3.received()
+	if len(got) != 1 || got[0].from != "" || strings.Join(got[0].to, ",") != "sender@example.net" {
+		t.Fatalf("mx3 received %+v", got)
+	}
+	if !strings.Contains(got[0].data, "<unknown@example.com>: host mx1.example.com said: 550 5.1.0 ") ||
+		!strings.Contains(got[0].data, "Subject: Test\n") {
+		t.Errorf("bounce is %q", got[0].data)
+	}
+
+	// Bounces honor RET and ENVID given with MAIL.
+	info := &SessionInfo{MailParams: map[string]string{"RET": "FULL", "ENVID": "QQ+2B314159"}}
+	ctx := context.WithValue(context.Background(), sessionKey{}, info)
+	if err := r.DeliverContext(ctx, nil, "sender@example.net", to[:2], strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	got = mx3.received()
+	if len(got) != 2 || !strings.Contains(got[1].data, "Original-Envelope-Id: QQ+314159\n") ||
+		!strings.Contains(got[1].data, "Content-Type: message/rfc822\nContent-Description: Undelivered Message\n\nSubject: Test\n\nHello.\n") {
+		t.Errorf("bounce is %q", got[1].data)
+	}
+
+	// Messages no recipient accepted are rejected. Settings changes only
+	// apply to new connections.
+	r.Close()
+	tests := []struct {
+		tls  RelayTLSPolicy
+		to   string
+		want string
+	}{
+		{RelayTLSOpportunistic, "unknown@example.com", "550 5.1.0 "},
+		{RelayTLSOpportunistic, "a@nullmx.example.com", "556 5.1.10 "},
+		{RelayTLSOpportunistic, "a@empty.example.com", "550 5.1.2 "},
+		{RelayTLSOpportunistic, "a@unknown.example.com", "451 4.4.3 "},
+		{RelayTLSRequired, "bob@example.org", "454 4.7.10 "},
+	}
+	for _, tt := range tests {
+		r.TLS = tt.tls
+		err := r.Deliver(nil, "sender@example.net", []string{tt.to}, strings.NewReader(msg))
+		if _, ok := err.(*Error); !ok || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("delivery to %s returned %v, want %q", tt.to, err, tt.want)
+		}
+	}
+	if n := len(mx3.received()); n != 2 {
+		t.Errorf("mx3 received %d messages, want 2", n)
+	}
+
+	// Without any host to try every recipient fails permanently.
+	if failures := r.sendHost(nil, "sender@example.net", []string{"a@example.com"}, []byte(msg)); len(failures) != 1 || failures[0].Err.Code != 550 {
+		t.Errorf("sending to no hosts returned %+v", failures)
+	}
+}
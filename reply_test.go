@@ -0,0 +1,45 @@
+package smtpd
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestReplyText(t *testing.T) {
+	server := &Server{
+		Hostname: "mail.example.com",
+		Appname:  "secret",
+		Banner:   "ESMTP ready\nNo unsolicited mail",
+		Greeting: "at your service",
+		Goodbye:  "Bye",
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			return &Error{Code: 554, EnhancedCode: "5.7.1", Message: "Rejected by 100% of filters\nSee https://example.com/policy"}
+		},
+	}
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	clientConn.SetDeadline(time.Now().Add(2 * time.Second))
+	serverConn.SetDeadline(time.Now().Add(2 * time.Second))
+	go server.newSession(serverConn).serve()
+	conn := textproto.NewConn(clientConn)
+
+	if _, msg, err := conn.ReadResponse(220); err != nil || msg != "mail.example.com ESMTP ready\nNo unsolicited mail" {
+		t.Fatalf("banner %q, %v", msg, err)
+	}
+	cmdCode(t, clientConn, "HELO host.example.com", 250)
+	if msg := cmdCode(t, clientConn, "EHLO host.example.com", 250); msg != "mail.example.com at your service\nSIZE 0\nENHANCEDSTATUSCODES" {
+		t.Errorf("EHLO replied %q", msg)
+	}
+	cmdCode(t, clientConn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, clientConn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, clientConn, "DATA", 354)
+	if msg := cmdCode(t, clientConn, "Subject: Test\r\n\r\nHello.\r\n.", 554); msg != "5.7.1 Rejected by 100% of filters\n5.7.1 See https://example.com/policy" {
+		t.Errorf("DATA replied %q", msg)
+	}
+	if msg := cmdCode(t, clientConn, "QUIT", 221); msg != "2.0.0 Bye" {
+		t.Errorf("QUIT replied %q", msg)
+	}
+}
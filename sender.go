@@ -0,0 +1,125 @@
+package smtpd
+
+import (
+	"net"
+	"net/mail"
+	"strings"
+)
+
+// SenderPolicy restricts authenticated users to sending as addresses they
+// own. Both the reverse-path given with MAIL and the addresses in the From
+// and Sender header fields are checked against the user's identities, and
+// unowned ones are rejected with 553 5.7.1, at MAIL and at the end of DATA
+// respectively.
+type SenderPolicy struct {
+	// User returns the user the session is authenticated as, or "" if the
+	// client is not authenticated, in which case its senders are not checked.
+	// The server has no AUTH command, so clients are authenticated by the
+	// application, e.g. from the TLS client certificate or remote address.
+	User func(info *SessionInfo) string
+
+	// Identities returns the addresses the user may send as. An entry of the
+	// form "@example.com" allows any address in the domain.
+	Identities func(user string) ([]string, error)
+
+	// Rewrite replaces unowned senders with the first identity that is a full
+	// address instead of rejecting them: the reverse-path, and the From field
+	// keeping its display name. An unowned Sender field is removed.
+	Rewrite bool
+}
+
+// errSenderNotOwned is returned for a sender the authenticated user does not own.
+var errSenderNotOwned = &Error{Code: 553, EnhancedCode: "5.7.1", Message: "Sender address rejected: not owned by user"}
+
+// errSenderLookup is returned when the user's identities cannot be looked up.
+var errSenderLookup = &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Sender address lookup failed"}
+
+// Return whether identities include addr, ignoring case.
+func ownsAddress(identities []string, addr string) bool {
+	for _, id := range identities {
+		if strings.HasPrefix(id, "@") {
+			if i := strings.LastIndex(addr, "@"); i >= 0 && strings.EqualFold(addr[i:], id) {
+				return true
+			}
+		} else if strings.EqualFold(addr, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the first identity that is a full address, or "".
+func primaryIdentity(identities []string) string {
+	for _, id := range identities {
+		if !strings.HasPrefix(id, "@") {
+			return id
+		}
+	}
+	return ""
+}
+
+// checkSender returns the reverse-path to use for a MAIL command from user,
+// which is from unless it is rewritten. The null reverse-path is allowed.
+func (policy *SenderPolicy) checkSender(user, from string) (string, error) {
+	if from == "" {
+		return from, nil
+	}
+	identities, err := policy.Identities(user)
+	if err != nil {
+		return "", errSenderLookup
+	}
+	if ownsAddress(identities, from) {
+		return from, nil
+	}
+	if primary := primaryIdentity(identities); policy.Rewrite && primary != "" {
+		return primary, nil
+	}
+	return "", errSenderNotOwned
+}
+
+// senderFilter returns a message filter checking the From and Sender fields
+// of messages sent by user.
+func senderFilter(policy *SenderPolicy, user string) messageFilter {
+	return func(remoteAddr net.Addr, from string, to []string, msg *message) error {
+		identities, err := policy.Identities(user)
+		if err != nil {
+			return errSenderLookup
+		}
+		primary := primaryIdentity(identities)
+		owned := func(f headerField) bool {
+			addrs, err := mail.ParseAddressList(f.value())
+			if err != nil {
+				return false
+			}
+			for _, addr := range addrs {
+				if !ownsAddress(identities, addr.Address) {
+					return false
+				}
+			}
+			return true
+		}
+
+		for i, f := range msg.header {
+			if !strings.EqualFold(f.name, "From") || owned(f) {
+				continue
+			}
+			if !policy.Rewrite || primary == "" {
+				return errSenderNotOwned
+			}
+			addr := &mail.Address{Address: primary}
+			if addrs, err := mail.ParseAddressList(f.value()); err == nil && len(addrs) > 0 {
+				addr.Name = addrs[0].Name
+			}
+			msg.header[i] = newHeaderField(f.name, addr.String(), msg.eol)
+		}
+		for _, f := range msg.get("Sender") {
+			if !owned(f) && !policy.Rewrite {
+				return errSenderNotOwned
+			}
+		}
+		msg.remove(func(f headerField) bool {
+			return strings.EqualFold(f.name, "Sender") && !owned(f)
+		})
+		return nil
+	}
+}
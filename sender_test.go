@@ -0,0 +1,69 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSenderPolicy(t *testing.T) {
+	var received, receivedFrom string
+	policy := &SenderPolicy{
+		User: func(info *SessionInfo) string {
+			if info.Helo == "anonymous.example.com" {
+				return ""
+			}
+			return strings.TrimSuffix(info.Helo, ".example.com")
+		},
+		Identities: func(user string) ([]string, error) {
+			if user == "broken" {
+				return nil, errors.New("database unavailable")
+			}
+			return []string{"alice@example.com", "@example.org"}, nil
+		},
+	}
+	server := &Server{
+		SenderPolicy: policy,
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			received, receivedFrom = string(b), from
+			return err
+		},
+	}
+	send := func(helo, from, header string, mailCode, dataCode int) string {
+		conn := newConn(t, server)
+		defer conn.Close()
+		cmdCode(t, conn, "EHLO "+helo, 250)
+		msg := cmdCode(t, conn, "MAIL FROM:<"+from+">", mailCode)
+		if mailCode == 250 {
+			cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+			cmdCode(t, conn, "DATA", 354)
+			msg = cmdCode(t, conn, header+"\r\nHello.\r\n.", dataCode)
+		}
+		cmdCode(t, conn, "QUIT", 221)
+		return msg
+	}
+
+	if msg := send("alice.example.com", "bob@example.com", "", 553, 0); msg != "5.7.1 Sender address rejected: not owned by user" {
+		t.Errorf("MAIL rejected with %q", msg)
+	}
+	send("alice.example.com", "BOB@example.ORG", "From: bob@example.org\r\n", 250, 250)
+	send("alice.example.com", "", "From: alice@example.com\r\n", 250, 250)
+	send("alice.example.com", "alice@example.com", "From: Bob <bob@example.com>\r\n", 250, 553)
+	send("alice.example.com", "alice@example.com", "From: alice@example.com\r\nSender: bob@example.com\r\n", 250, 553)
+	send("anonymous.example.com", "bob@example.com", "From: bob@example.com\r\n", 250, 250)
+	send("broken.example.com", "alice@example.com", "", 451, 0)
+
+	// Unowned senders are rewritten to the first full address.
+	policy.Rewrite = true
+	send("alice.example.com", "bob@example.com", "From: Bob <bob@example.com>\r\nSender: bob@example.com\r\nSubject: Hi\r\n", 250, 250)
+	if receivedFrom != "alice@example.com" {
+		t.Errorf("reverse-path %q", receivedFrom)
+	}
+	if want := "From: \"Bob\" <alice@example.com>\nSubject: Hi\n\nHello.\n"; received != want {
+		t.Errorf("received %q, want %q", received, want)
+	}
+}
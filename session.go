@@ -1,13 +1,17 @@
 package smtpd
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/textproto"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -18,21 +22,82 @@ type session struct {
 	conn   net.Conn
 	tpconn *textproto.Conn
 
-	remoteIP   string // Remote IP address
-	remoteHost string // Remote hostname according to reverse DNS lookup
-	remoteName string // Remote hostname as supplied with EHLO
-	tls        bool
+	id           string // Random session identifier used in logs
+	start        time.Time
+	remoteIP     string   // Remote IP address
+	remoteHost   string   // Remote hostname according to reverse DNS lookup
+	remoteName   string   // Remote hostname as supplied with EHLO
+	heloFailures []string // HeloPolicy checks remoteName failed without being rejected
+	tls          bool
+	verb         string // Command being replied to
+	transcript   TranscriptWriter
+
+	// Trace spans of the session and the current command.
+	ctx     context.Context
+	span    Span
+	cmdCtx  context.Context
+	cmdSpan Span
+
+	// Current mail transaction.
+	from    string
+	gotFrom bool
+	params  map[string]string // ESMTP parameters given with MAIL
+	user    string            // User the sender was checked against, if any
+	to      []string
+}
+
+// Reset the current mail transaction.
+func (s *session) reset() {
+	s.from = ""
+	s.gotFrom = false
+	s.params = nil
+	s.user = ""
+	s.to = nil
 }
 
 // Function called to handle connection requests.
 func (s *session) serve() {
 	defer s.conn.Close()
-	var from string
-	var gotFrom bool
-	var to []string
+
+	reason := "client disconnected"
+	s.srv.Metrics.connectionOpened()
+	s.log(LogInfo, "connection opened", "remote_host", s.remoteHost, "local_addr", s.conn.LocalAddr(), "tls", s.tls)
+	s.startTranscript()
+	s.ctx, s.span = s.startSpan(context.Background(), SpanSession, "smtp.session_id", s.id, "smtp.remote_ip", s.remoteIP)
+	defer func() {
+		s.endCommand()
+		s.span.SetAttributes("smtp.close_reason", reason)
+		s.span.End()
+		s.closeTranscript(reason)
+		s.srv.Metrics.connectionClosed(time.Since(s.start))
+		s.log(LogInfo, "connection closed", "reason", reason, "duration", time.Since(s.start))
+	}()
+
+	// Complete the handshake of connections accepted by a TLS listener up
+	// front, so it can be logged and counted.
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		if err := s.handshake(tlsConn); err != nil {
+			reason = "TLS handshake failed"
+			return
+		}
+	}
+
+	// Let the application turn the client away before the banner.
+	if s.srv.HandlerConnect != nil {
+		if err := s.srv.HandlerConnect(s.info()); err != nil {
+			reason = "connection rejected"
+			s.log(LogWarn, "connection rejected", "error", err)
+			if serr, ok := err.(*Error); ok {
+				s.replyError(serr)
+			} else {
+				s.reply(421, "4.3.0", s.srv.Hostname+" Service not available, closing transmission channel")
+			}
+			return
+		}
+	}
 
 	// Send banner.
-	s.writef("220 %s %s ESMTP Service ready", s.srv.Hostname, s.srv.Appname)
+	s.reply(220, "", s.srv.banner()...)
 
 loop:
 	for {
@@ -40,32 +105,61 @@ loop:
 		// On timeout, send a timeout message and return from serve().
 		// On error, assume the client has gone away i.e. return from serve().
 
+		s.endCommand()
+		s.verb = ""
 		line, err := s.readLine()
+		if err == errLineTooLong {
+			s.writef("500 5.5.6 Line too long")
+			continue
+		}
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				reason = "timeout"
 				s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
+			} else if err != io.EOF {
+				reason = err.Error()
 			}
 			break
 		}
 		verb, args := s.parseLine(line)
+		s.verb = verb
+		s.startCommand(verb)
+
+		// NUL is not permitted anywhere in a command (RFC 5321 section 4.1.1).
+		if strings.IndexByte(line, 0) != -1 {
+			s.writef("500 5.5.2 Syntax error (NUL character not permitted)")
+			continue
+		}
 
 		switch verb {
 		case "HELO":
+			if len(args) > maxDomainLength {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (domain too long)")
+				break
+			}
+			if !s.checkHelo(args) {
+				break
+			}
 			s.remoteName = args
-			s.writef("250 %s greets %s", s.srv.Hostname, s.remoteName)
+			s.span.SetAttributes("smtp.helo", args)
+			s.reply(250, "", s.greeting())
 
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET, so reset for HELO too.
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
 		case "EHLO":
+			if len(args) > maxDomainLength {
+				s.writef("501 5.5.4 Syntax error in parameters or arguments (domain too long)")
+				break
+			}
+			if !s.checkHelo(args) {
+				break
+			}
 			s.remoteName = args
-			s.writef(s.makeEHLOResponse())
+			s.span.SetAttributes("smtp.helo", args)
+			s.writeLines(strings.Split(s.makeEHLOResponse(), "\r\n"))
 
 			// RFC 2821 section 4.1.4 specifies that EHLO has the same effect as RSET.
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
 		case "MAIL":
 			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
 				s.writef("530 5.7.0 Must issue a STARTTLS command first")
@@ -75,33 +169,35 @@ loop:
 			match := mailFromRE.FindStringSubmatch(args)
 			if match == nil {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid FROM parameter)")
+			} else if pathTooLong(match[1]) {
+				s.log(LogWarn, "mail rejected", "error", "path too long")
+				s.writef("501 5.1.7 Path too long")
 			} else {
-				// Validate the SIZE parameter if one was sent.
-				if len(match[2]) > 0 { // A parameter is present
-					sizeMatch := mailSizeRE.FindStringSubmatch(match[3])
-					if sizeMatch == nil {
-						s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-					} else {
-						// Enforce the maximum message size if one is set.
-						size, err := strconv.Atoi(sizeMatch[1])
-						if err != nil { // Bad SIZE parameter
-							s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid SIZE parameter)")
-						} else if s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
-							err = maxSizeExceeded(s.srv.MaxSize)
-							s.writef(err.Error())
-						} else { // SIZE ok
-							from = match[1]
-							gotFrom = true
-							s.writef("250 2.1.0 Ok")
-						}
+				params, err := parseMailParams(match[3])
+				size, hasSize := 0, false
+				if value, ok := params["SIZE"]; err == nil && ok {
+					// Validate the SIZE parameter if one was sent.
+					hasSize = true
+					if size, err = strconv.Atoi(value); err != nil || strings.Trim(value, "0123456789") != "" {
+						err = errors.New("invalid SIZE parameter")
 					}
-				} else { // No parameters after FROM
-					from = match[1]
-					gotFrom = true
-					s.writef("250 2.1.0 Ok")
+				}
+				if err != nil {
+					s.writef("501 5.5.4 Syntax error in parameters or arguments (%s)", err)
+				} else if keyword := s.srv.unknownMailParam(params); keyword != "" {
+					s.log(LogWarn, "mail rejected", "error", "unsupported parameter", "param", keyword)
+					s.writef("555 5.5.4 MAIL FROM parameter %s not recognized or not implemented", keyword)
+				} else if hasSize && s.srv.MaxSize > 0 && size > s.srv.MaxSize { // SIZE above maximum size, if set
+					err = maxSizeExceeded(s.srv.MaxSize)
+					s.log(LogWarn, "mail rejected", "size", size, "error", err)
+					s.writef("%s", err.Error())
+				} else if hasSize {
+					s.mailFrom(match[1], params, "size", size)
+				} else {
+					s.mailFrom(match[1], params)
 				}
 			}
-			to = nil
+			s.to = nil
 			// buffer.Reset()
 		case "RCPT":
 			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
@@ -109,7 +205,7 @@ loop:
 				break
 			}
 
-			if !gotFrom {
+			if !s.gotFrom {
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL required before RCPT)")
 				break
 			}
@@ -117,20 +213,37 @@ loop:
 			match := rcptToRE.FindStringSubmatch(args)
 			if match == nil {
 				s.writef("501 5.5.4 Syntax error in parameters or arguments (invalid TO parameter)")
+			} else if pathTooLong(match[1]) {
+				s.log(LogWarn, "rcpt rejected", "error", "path too long")
+				s.writef("501 5.1.3 Path too long")
 			} else {
 				// RFC 5321 specifies 100 minimum recipients
 				// https://tools.ietf.org/html/rfc5321#section-4.5.3.1.10
-				if len(to) == 100 {
+				if len(s.to) == 100 {
+					s.log(LogWarn, "rcpt rejected", "to", match[1], "error", "too many recipients")
 					s.writef("452 4.5.3 Too many recipients")
 				} else {
 					accept := true
-					if s.srv.HandlerRcpt != nil {
-						accept = s.srv.HandlerRcpt(s.conn.RemoteAddr(), from, match[1])
+					if s.srv.VerifyRcpt != nil {
+						if err := s.srv.VerifyRcpt(s.conn.RemoteAddr(), s.from, match[1]); err != nil {
+							s.log(LogWarn, "rcpt rejected", "to", match[1], "error", err)
+							if serr, ok := err.(*Error); ok {
+								s.replyError(serr)
+							} else {
+								s.writef("451 4.3.0 Requested action aborted: local error in processing")
+							}
+							break
+						}
+					} else if s.srv.HandlerRcpt != nil {
+						accept = s.srv.HandlerRcpt(s.conn.RemoteAddr(), s.from, match[1])
 					}
 					if accept {
-						to = append(to, match[1])
+						s.to = append(s.to, match[1])
+						s.log(LogInfo, "rcpt to", "to", match[1])
+						s.cmdSpan.SetAttributes("smtp.rcpt_count", len(s.to))
 						s.writef("250 2.1.5 Ok")
 					} else {
+						s.log(LogWarn, "rcpt rejected", "to", match[1], "error", "mailbox unavailable")
 						s.writef("550 5.1.0 Requested action not taken: mailbox unavailable")
 					}
 				}
@@ -141,7 +254,7 @@ loop:
 				break
 			}
 
-			if !gotFrom || len(to) == 0 {
+			if !s.gotFrom || len(s.to) == 0 {
 				s.writef("503 5.5.1 Bad sequence of commands (MAIL & RCPT required before DATA)")
 				break
 			}
@@ -149,52 +262,100 @@ loop:
 			s.writef("354 Start mail input; end with <CR><LF>.<CR><LF>")
 
 			// Regardless of the limit desired, this is useful to track how much we
-			// have already read in the handler
-			r := &MaxReader{Reader: s.tpconn.DotReader(), MaxBytes: s.srv.MaxSize}
+			// have already read in the handler. The transcript records the body
+			// as it is read, including any rest discarded after a rejection.
+			dot := s.tpconn.DotReader()
+			if s.transcript != nil {
+				dot = io.TeeReader(dot, transcriptBody{s})
+			}
+			lines := &lineLimitReader{Reader: dot, limit: s.srv.maxLineLength(), reject: s.srv.RejectLongLines}
+			r := &MaxReader{Reader: lines, MaxBytes: s.srv.MaxSize}
 
 			// Create Received header & write message body into buffer.
 			// buffer.Write(s.makeHeaders(to))
 
-			if s.srv.Handler != nil {
-				err = s.srv.Handler(s.conn.RemoteAddr(), from, to, r)
-			} else {
-				// discard
-				_, err = io.Copy(ioutil.Discard, r)
+			dataStart := time.Now()
+			ctx, span := s.startSpan(s.context(), SpanHandler, "smtp.from", s.from, "smtp.rcpt_count", len(s.to))
+			ctx = context.WithValue(ctx, sessionKey{}, s.info())
+			var queueID string
+			ctx = context.WithValue(ctx, queueIDKey{}, &queueID)
+			ctx = context.WithValue(ctx, longLinesKey{}, lines)
+			err = s.handler(ctx)(s.conn.RemoteAddr(), s.from, s.to, r)
+			span.SetAttributes("smtp.bytes", r.BytesRead, "smtp.long_lines", lines.long)
+			if err != nil {
+				span.RecordError(err)
 			}
+			span.End()
 
 			if err != nil {
+				s.log(LogWarn, "message rejected", "rcpts", len(s.to), "bytes", r.BytesRead, "error", err)
 				switch err.(type) {
 				case net.Error:
+					s.srv.Metrics.message(r.BytesRead, time.Since(dataStart), RejectNetwork)
 					if err.(net.Error).Timeout() {
 						s.writef("421 4.4.2 %s %s ESMTP Service closing transmission channel after timeout exceeded", s.srv.Hostname, s.srv.Appname)
 					}
+					reason = "data: " + err.Error()
 					break loop
 				case maxSizeExceededError:
-					s.writef(err.Error())
+					s.srv.Metrics.message(r.BytesRead, time.Since(dataStart), RejectMaxSize)
+					s.writef("%s", err.Error())
+					continue
+				case *Error:
+					s.srv.Metrics.message(r.BytesRead, time.Since(dataStart), RejectHandler)
+					// The handler may reject the message without reading all of it.
+					if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+						reason = "data: " + err.Error()
+						break loop
+					}
+					s.replyError(err.(*Error))
+					continue
+				case lineTooLongError:
+					s.srv.Metrics.message(r.BytesRead, time.Since(dataStart), RejectLineLength)
+					// Discard the rest of the message so the reply follows the end of DATA.
+					if _, err := io.Copy(ioutil.Discard, dot); err != nil {
+						reason = "data: " + err.Error()
+						break loop
+					}
+					s.writef("%s", err.Error())
 					continue
 				default:
+					s.srv.Metrics.message(r.BytesRead, time.Since(dataStart), RejectHandler)
 					// s.writef("451 4.3.0 Requested action aborted: local error in processing")
-					s.writef("451 4.3.0 Requested action aborted: " + err.Error())
+					s.reply(451, "4.3.0", "Requested action aborted: "+err.Error())
 					continue
 				}
 			}
+			s.srv.Metrics.message(r.BytesRead, time.Since(dataStart), "")
 
 			// Read anything left
 			// io.Copy(ioutil.Discard, r)
 
 			// Mail processing complete
 			if s.srv.HandlerSuccess != nil {
-				s.srv.HandlerSuccess(r.BytesRead, s.conn.RemoteAddr(), from, to)
+				s.srv.HandlerSuccess(r.BytesRead, s.conn.RemoteAddr(), s.from, s.to)
 			}
 
-			s.writef("250 2.0.0 Ok: queued")
+			fields := []interface{}{"rcpts", len(s.to), "bytes", r.BytesRead}
+			if queueID != "" {
+				fields = append(fields, "queue_id", queueID)
+			}
+			if lines.long > 0 {
+				s.log(LogWarn, "message accepted", append(fields, "long_lines", lines.long)...)
+			} else {
+				s.log(LogInfo, "message accepted", fields...)
+			}
+			if queueID != "" {
+				s.writef("250 2.0.0 Ok: queued as %s", queueID)
+			} else {
+				s.writef("250 2.0.0 Ok: queued")
+			}
 
 			// Reset for next mail.
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
 		case "QUIT":
-			s.writef("221 2.0.0 %s %s ESMTP Service closing transmission channel", s.srv.Hostname, s.srv.Appname)
+			reason = "quit"
+			s.reply(221, "2.0.0", s.srv.goodbye()...)
 			break loop
 		case "RSET":
 			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
@@ -202,14 +363,22 @@ loop:
 				break
 			}
 			s.writef("250 2.0.0 Ok")
-			from = ""
-			gotFrom = false
-			to = nil
+			s.reset()
 		case "NOOP":
 			s.writef("250 2.0.0 Ok")
-		case "HELP", "VRFY", "EXPN":
-			// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
-			s.writef("502 5.5.1 Command not implemented")
+		case "VRFY", "EXPN":
+			if !s.srv.Vrfy.implements(verb) {
+				// See RFC 5321 section 4.2.4 for usage of 500 & 502 response codes.
+				s.writef("502 5.5.1 Command not implemented")
+				break
+			}
+			if s.srv.TLSConfig != nil && s.srv.TLSRequired && !s.tls {
+				s.writef("530 5.7.0 Must issue a STARTTLS command first")
+				break
+			}
+			s.vrfy(verb, args)
+		case "HELP":
+			s.help(args)
 		case "STARTTLS":
 			// Parameters are not allowed (RFC 3207 section 4).
 			if args != "" {
@@ -233,7 +402,7 @@ loop:
 
 			// Establish a TLS connection with the client.
 			tlsConn := tls.Server(s.conn, s.srv.TLSConfig)
-			err := tlsConn.Handshake()
+			err := s.handshake(tlsConn)
 			if err != nil {
 				s.writef("403 4.7.0 TLS handshake failed")
 				break
@@ -246,9 +415,8 @@ loop:
 
 			// RFC 3207 specifies that the server must discard any prior knowledge obtained from the client.
 			s.remoteName = ""
-			from = ""
-			gotFrom = false
-			to = nil
+			s.heloFailures = nil
+			s.reset()
 		case "AUTH":
 
 			// RFC 4954 also specifies that ESMTP code 5.5.4 ("Invalid command arguments")
@@ -267,8 +435,205 @@ loop:
 	}
 }
 
+// Parse the ESMTP parameters of a MAIL command (RFC 5321 section 4.1.2),
+// returning them keyed by upper case keyword. Keywords without a value map to
+// the empty string.
+func parseMailParams(args string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, param := range strings.Fields(args) {
+		keyword, value := param, ""
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			keyword, value = param[:i], param[i+1:]
+			if value == "" {
+				return nil, fmt.Errorf("invalid %s parameter", strings.ToUpper(keyword))
+			}
+		}
+		keyword = strings.ToUpper(keyword)
+		if keyword == "" || strings.Trim(keyword, "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" || keyword[0] == '-' {
+			return nil, errors.New("invalid parameter")
+		}
+		if _, ok := params[keyword]; ok {
+			return nil, fmt.Errorf("duplicate %s parameter", keyword)
+		}
+		params[keyword] = value
+	}
+	return params, nil
+}
+
+// Extensions defining MAIL parameters, listed in replies to EHLO when the
+// parameter is in AllowedMailParams. Some are never listed: AUTH as the
+// extension lists the SASL mechanisms offered, which the server does not
+// implement, and RET and ENVID as DSN also needs the RCPT parameters NOTIFY
+// and ORCPT, which are not passed on.
+var mailParamExtensions = map[string]string{
+	"BODY":     "8BITMIME",
+	"SMTPUTF8": "SMTPUTF8",
+	"RET":      "",
+	"ENVID":    "",
+	"AUTH":     "",
+}
+
+// Return the first keyword of params the server does not accept, or "".
+func (srv *Server) unknownMailParam(params map[string]string) string {
+	if len(srv.AllowedMailParams) == 0 {
+		return ""
+	}
+	var unknown []string
+	for keyword := range params {
+		if keyword != "SIZE" && !containsFold(srv.AllowedMailParams, keyword) {
+			unknown = append(unknown, keyword)
+		}
+	}
+	if len(unknown) == 0 {
+		return ""
+	}
+	sort.Strings(unknown)
+	return unknown[0]
+}
+
+// Start a mail transaction from the sender, unless it is rejected by the
+// SenderPolicy or HandlerMail.
+func (s *session) mailFrom(from string, params map[string]string, fields ...interface{}) {
+	user := ""
+	if s.srv.SenderPolicy != nil {
+		user = s.srv.SenderPolicy.User(s.info())
+	}
+	if user != "" {
+		checked, err := s.srv.SenderPolicy.checkSender(user, from)
+		if err != nil {
+			s.log(LogWarn, "mail rejected", append(fields, "sender", from, "user", user, "error", err)...)
+			s.replyError(err.(*Error))
+			return
+		}
+		if checked != from {
+			fields = append(fields, "rewritten_from", from)
+		}
+		from = checked
+	}
+	if s.srv.HandlerMail != nil {
+		if err := s.srv.HandlerMail(s.conn.RemoteAddr(), from, params); err != nil {
+			s.log(LogWarn, "mail rejected", append(fields, "sender", from, "error", err)...)
+			if serr, ok := err.(*Error); ok {
+				s.replyError(serr)
+			} else {
+				s.writef("451 4.3.0 Requested action aborted: local error in processing")
+			}
+			return
+		}
+	}
+	s.from = from
+	s.gotFrom = true
+	s.params = params
+	s.user = user
+	s.log(LogInfo, "mail from", fields...)
+	s.cmdSpan.SetAttributes("smtp.from", s.from)
+	s.writef("250 2.1.0 Ok")
+}
+
+// Perform a TLS handshake, recording the outcome.
+func (s *session) handshake(tlsConn *tls.Conn) error {
+	_, span := s.startSpan(s.context(), SpanTLSHandshake)
+	defer span.End()
+
+	err := tlsConn.Handshake()
+	state := tlsConn.ConnectionState()
+	s.srv.Metrics.tlsHandshake(state.Version, state.CipherSuite, err)
+	if err != nil {
+		span.RecordError(err)
+		s.log(LogWarn, "TLS handshake failed", "error", err)
+		return err
+	}
+	span.SetAttributes("tls.version", tlsVersionName(state.Version), "tls.cipher", tls.CipherSuiteName(state.CipherSuite))
+	s.log(LogInfo, "TLS handshake", "version", tlsVersionName(state.Version), "cipher", tls.CipherSuiteName(state.CipherSuite))
+	s.record(TranscriptTLS, tlsVersionName(state.Version)+" "+tls.CipherSuiteName(state.CipherSuite))
+	return nil
+}
+
+// Return the handler for the DATA body, wrapped with any message processing
+// configured on the server. ctx is passed on to HandlerContext.
+func (s *session) handler(ctx context.Context) Handler {
+	handler := s.srv.Handler
+	if s.srv.HandlerContext != nil {
+		handler = func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			ctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			return s.srv.HandlerContext(ctx, remoteAddr, from, to, body)
+		}
+	}
+	if handler == nil {
+		handler = func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			// discard
+			_, err := io.Copy(ioutil.Discard, body)
+			return err
+		}
+	}
+
+	// Authentication results are checked on the message as received, and the
+	// ARC seal covers every later change.
+	var filters []messageFilter
+	var seal messageFilter
+	if s.srv.AuthResults != nil || s.srv.ARC != nil {
+		var check messageFilter
+		check, seal = s.srv.authFilters(s.info())
+		filters = append(filters, check)
+	}
+	if s.srv.HeaderPolicy != nil {
+		filters = append(filters, headerFilter(s.srv.HeaderPolicy, s.srv.Hostname, s.info()))
+	}
+	if s.user != "" {
+		filters = append(filters, senderFilter(s.srv.SenderPolicy, s.user))
+	}
+	if s.srv.DKIM != nil {
+		filters = append(filters, dkimFilter(s.srv.DKIM, s.info()))
+	}
+	if seal != nil {
+		filters = append(filters, seal)
+	}
+
+	if len(filters) > 0 {
+		handler = filterHandler(filters, handler)
+	}
+	return handler
+}
+
 // Wrapper function for writing a complete line to the socket.
-func (s *session) writef(format string, args ...interface{}) (err error) {
+func (s *session) writef(format string, args ...interface{}) error {
+	return s.writeLines(strings.Split(fmt.Sprintf(format, args...), "\r\n"))
+}
+
+// Write a reply to the socket, with the code and enhanced status code, if
+// any, prefixed to each of the lines.
+func (s *session) reply(code int, enhancedCode string, lines ...string) error {
+	return s.writeLines(replyLines(code, enhancedCode, lines...))
+}
+
+// Return the lines of a multi-line reply (RFC 5321 section 4.2.1): the code
+// is followed by "-" on all lines but the last.
+func replyLines(code int, enhancedCode string, lines ...string) []string {
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	reply := make([]string, len(lines))
+	for i, line := range lines {
+		prefix := strconv.Itoa(code) + "-"
+		if i == len(lines)-1 {
+			prefix = strconv.Itoa(code) + " "
+		}
+		if enhancedCode != "" {
+			prefix += enhancedCode + " "
+		}
+		reply[i] = prefix + line
+	}
+	return reply
+}
+
+// Write an *Error as reply, each line of its message on a reply line.
+func (s *session) replyError(err *Error) error {
+	return s.reply(err.Code, err.EnhancedCode, strings.Split(err.Message, "\n")...)
+}
+
+// Write the lines of a reply to the socket.
+func (s *session) writeLines(lines []string) (err error) {
 	if s.srv.Timeout > 0 {
 		err = s.conn.SetWriteDeadline(time.Now().Add(s.srv.Timeout))
 		if err != nil {
@@ -276,12 +641,20 @@ func (s *session) writef(format string, args ...interface{}) (err error) {
 		}
 	}
 
-	err = s.tpconn.Writer.PrintfLine(format, args...)
+	w := s.tpconn.Writer.W
+	for _, line := range lines {
+		w.WriteString(line)
+		w.WriteString("\r\n")
+	}
+	err = w.Flush()
 
-	if Debug {
-		line := fmt.Sprintf(format, args...)
-		verb := "WROTE"
-		log.Println(s.remoteIP, verb, line)
+	if s.verb != "" && len(lines[0]) >= 3 {
+		s.srv.Metrics.command(s.verb, lines[0][:3])
+		s.cmdSpan.SetAttributes("smtp.reply_code", lines[0][:3])
+	}
+	for _, line := range lines {
+		s.logWrite(line)
+		s.record(TranscriptWrite, line)
 	}
 
 	return
@@ -296,28 +669,86 @@ func (s *session) readLine() (line string, err error) {
 		}
 	}
 
-	line, err = s.tpconn.ReadLine()
+	line, err = readLimitedLine(s.tpconn.R, s.srv.maxCommandLength())
 
-	if Debug {
-		verb := "READ"
-		log.Println(s.remoteIP, verb, line)
+	if err == nil {
+		s.logRead(line)
+		s.record(TranscriptRead, redactAuth(line))
+	} else if err == errLineTooLong {
+		// Record what was read so replay still sends a line here.
+		s.recordEntry(TranscriptEntry{Kind: TranscriptRead, Text: redactAuth(line), Truncated: true})
 	}
 
 	return
 }
 
-// Parse a line read from the socket.
+// Read a line of at most limit octets, including the line ending, and return
+// it without the line ending. The rest of longer lines is discarded and
+// errLineTooLong returned with the first limit octets, so the session can
+// continue with the next line.
+func readLimitedLine(r *bufio.Reader, limit int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			line = append(line, chunk[:limit-len(line)]...)
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil {
+				return "", err
+			}
+			return string(bytes.TrimSuffix(line, []byte("\r"))), errLineTooLong
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return string(line), nil
+}
+
+// Parse a line read from the socket. Only ASCII letters are upper-cased, so
+// verbs containing other characters never match a command.
 func (s *session) parseLine(line string) (verb string, args string) {
 	if idx := strings.Index(line, " "); idx != -1 {
-		verb = strings.ToUpper(line[:idx])
+		verb = asciiUpper(line[:idx])
 		args = strings.TrimSpace(line[idx+1:])
 	} else {
-		verb = strings.ToUpper(line)
+		verb = asciiUpper(line)
 		args = ""
 	}
 	return verb, args
 }
 
+func asciiUpper(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' {
+			b[i] -= 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// pathTooLong reports whether an address exceeds the limits of RFC 5321
+// section 4.5.3.1 on the local part, domain or whole path.
+func pathTooLong(addr string) bool {
+	if len(addr)+2 > maxPathLength {
+		return true
+	}
+	local, domain := addr, ""
+	if idx := strings.LastIndex(addr, "@"); idx != -1 {
+		local, domain = addr[:idx], addr[idx+1:]
+	}
+	return len(local) > maxLocalPartLength || len(domain) > maxDomainLength
+}
+
 // Create the Received header to comply with RFC 2821 section 3.8.2.
 // TODO: Work out what to do with multiple to addresses.
 // func (s *session) makeHeaders(to []string) []byte {
@@ -330,17 +761,38 @@ func (s *session) parseLine(line string) (verb string, args string) {
 // }
 
 // Create the greeting string sent in response to an EHLO command.
-func (s *session) makeEHLOResponse() (response string) {
-	response = fmt.Sprintf("250-%s greets %s\r\n", s.srv.Hostname, s.remoteName)
+func (s *session) makeEHLOResponse() string {
+	return strings.Join(replyLines(250, "", append([]string{s.greeting()}, s.extensions()...)...), "\r\n")
+}
 
+// Return the text of the reply to HELO and EHLO.
+func (s *session) greeting() string {
+	if s.srv.Greeting != "" {
+		return s.srv.Hostname + " " + s.srv.Greeting
+	}
+	return s.srv.Hostname + " greets " + s.remoteName
+}
+
+// Return the service extensions offered in reply to EHLO.
+func (s *session) extensions() []string {
 	// RFC 1870 specifies that "SIZE 0" indicates no maximum size is in force.
-	response += fmt.Sprintf("250-SIZE %d\r\n", s.srv.MaxSize)
+	extensions := []string{fmt.Sprintf("SIZE %d", s.srv.MaxSize)}
 
 	// Only list STARTTLS if TLS is configured, but not currently in use.
 	if s.srv.TLSConfig != nil && !s.tls {
-		response += "250-STARTTLS\r\n"
+		extensions = append(extensions, "STARTTLS")
 	}
 
-	response += "250 ENHANCEDSTATUSCODES"
-	return
+	// Advertise the extensions of the MAIL parameters accepted.
+	for _, keyword := range s.srv.AllowedMailParams {
+		extension, ok := mailParamExtensions[strings.ToUpper(keyword)]
+		if !ok {
+			extension = strings.ToUpper(keyword)
+		}
+		if extension != "" && !containsFold(extensions, extension) {
+			extensions = append(extensions, extension)
+		}
+	}
+
+	return append(extensions, "ENHANCEDSTATUSCODES")
 }
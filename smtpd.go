@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -12,15 +13,17 @@ import (
 	"net/textproto"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 )
 
 var (
-	// Debug `true` enables verbose logging.
+	// Debug `true` logs everything through the standard log package for servers without a Logger.
+	//
+	// Deprecated: set Server.Logger, e.g. to NewLogger(os.Stderr, LogDebug).
 	Debug      = false
 	rcptToRE   = regexp.MustCompile(`[Tt][Oo]:<(.+)>`)
-	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<(.*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
-	mailSizeRE = regexp.MustCompile(`[Ss][Ii][Zz][Ee]=(\d+)`)
+	mailFromRE = regexp.MustCompile(`[Ff][Rr][Oo][Mm]:<([^>]*)>(\s(.*))?`) // Delivery Status Notifications are sent with "MAIL FROM:<>"
 )
 
 // HandlerRcpt function called on RCPT. Return accept status.
@@ -29,9 +32,27 @@ type HandlerRcpt func(remoteAddr net.Addr, from string, to string) bool
 // Handler function called to process email DATA body
 type Handler func(remoteAddr net.Addr, from string, to []string, body io.Reader) error
 
+// HandlerMail function called on MAIL with the reverse-path and the ESMTP
+// parameters given with it, keyed by upper case keyword, e.g. "SIZE", "BODY",
+// "SMTPUTF8", "RET", "ENVID" or "AUTH", with the value as given or "" for
+// keywords without one. Return nil to accept the sender; an *Error is sent as
+// the reply, other errors are replied to with 451 4.3.0.
+type HandlerMail func(remoteAddr net.Addr, from string, params map[string]string) error
+
 // HandlerSuccess called after successful DATA body processed (used for stats)
 type HandlerSuccess func(bytesRead int, remoteAddr net.Addr, from string, to []string)
 
+// HandlerConnect function called when a client connects, before the banner is
+// sent. Return nil to accept the connection. Any other error closes the
+// connection after a reply. An *Error is sent as it is, e.g. ErrConnectRejected
+// to refuse the client for good, or 421 4.3.2 to have it try again later.
+// Other errors are replied to with 421 4.3.0, so the client retries: a
+// permanent refusal needs an *Error with a 554 code.
+type HandlerConnect func(info *SessionInfo) error
+
+// ErrConnectRejected is a HandlerConnect error refusing the client permanently.
+var ErrConnectRejected = &Error{Code: 554, EnhancedCode: "5.7.1", Message: "Client host rejected"}
+
 // ListenAndServe listens on the TCP network address addr
 // and then calls Serve with handler to handle requests
 // on incoming connections.
@@ -52,6 +73,43 @@ func ListenAndServeTLS(addr string, certFile string, keyFile string, handler Han
 	return srv.ListenAndServe()
 }
 
+// Size limits from RFC 5321 section 4.5.3.1.
+const (
+	maxCommandLineLength = 512  // Including CRLF, default for Server.MaxCommandLength
+	maxTextLineLength    = 1000 // Including CRLF, default for Server.MaxLineLength
+	maxLocalPartLength   = 64
+	maxDomainLength      = 255
+	maxPathLength        = 256 // Including the angle brackets
+)
+
+// errLineTooLong is returned when reading a command line over Server.MaxCommandLength.
+var errLineTooLong = errors.New("line too long")
+
+// lineTooLongError is returned when reading a DATA text line over Server.MaxLineLength.
+type lineTooLongError struct {
+	limit int
+}
+
+// Error uses the RFC 5321 response message, with the same enhanced status code as for command lines.
+func (err lineTooLongError) Error() string {
+	return fmt.Sprintf("500 5.5.6 Line too long (%d octets maximum)", err.limit)
+}
+
+// Error is an error carrying an SMTP reply. When a Handler returns one, its
+// reply is sent to the client instead of the default 451.
+type Error struct {
+	Code         int    // Reply code, e.g. 452
+	EnhancedCode string // Enhanced status code (RFC 3463), e.g. "4.2.2"
+	Message      string
+}
+
+func (err *Error) Error() string {
+	if err.EnhancedCode == "" {
+		return fmt.Sprintf("%d %s", err.Code, err.Message)
+	}
+	return fmt.Sprintf("%d %s %s", err.Code, err.EnhancedCode, err.Message)
+}
+
 type maxSizeExceededError struct {
 	limit int
 }
@@ -67,23 +125,51 @@ func (err maxSizeExceededError) Error() string {
 }
 
 // LogFunc is a function capable of logging the client-server communication.
+// It is called with the verb "READ" or "WROTE" for every line, in addition to
+// the debug level entries sent to Server.Logger.
 type LogFunc func(remoteIP, verb, line string)
 
 // Server is an SMTP server.
 type Server struct {
-	Addr           string // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
-	Appname        string
-	Handler        Handler
-	HandlerRcpt    HandlerRcpt
-	HandlerSuccess HandlerSuccess
-	Hostname       string
-	LogRead        LogFunc
-	LogWrite       LogFunc
-	MaxSize        int // Maximum message size allowed, in bytes
-	Timeout        time.Duration
-	TLSConfig      *tls.Config
-	TLSListener    bool // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
-	TLSRequired    bool // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	Addr              string   // TCP address to listen on, defaults to ":25" (all addresses, port 25) if empty
+	AllowedMailParams []string // Keywords of the MAIL parameters accepted besides SIZE, e.g. "BODY", rejecting others with 555 5.5.4; any parameter is accepted if empty
+	Appname           string
+	ARC               DKIMLookup        // Verify the ARC chain (RFC 8617) of accepted messages and seal them with the returned options, if any
+	AuthResults       AuthResultsLookup // Record authentication results in an Authentication-Results field (RFC 8601)
+	AuthServID        string            // authserv-id used in Authentication-Results fields, defaults to Hostname
+	Banner            string            // Text following Hostname in the 220 greeting, one reply line per line; defaults to Appname and "ESMTP Service ready"
+	DKIM              DKIMLookup        // Sign accepted messages before they are passed to Handler
+	Goodbye           string            // Text of the 221 reply to QUIT, one reply line per line; defaults to Hostname, Appname and "ESMTP Service closing transmission channel"
+	Greeting          string            // Text following Hostname in replies to HELO and EHLO; defaults to "greets" and the name given by the client
+	Handler           Handler
+	HandlerConnect    HandlerConnect // Called before the banner, turning the client away if it returns an error
+	HandlerContext    HandlerContext // Called in place of Handler if set, with a context carrying the trace span
+	HandlerHelo       HandlerHelo    // Called on HELO and EHLO after the HeloPolicy checks, replying with the returned error
+	HandlerMail       HandlerMail    // Called on MAIL after the SenderPolicy check, replying with the returned error
+	HandlerRcpt       HandlerRcpt
+	HandlerSuccess    HandlerSuccess
+	HeaderPolicy      *HeaderPolicy     // Validate the header fields of accepted messages (RFC 5322), nothing is checked if nil
+	HeloPolicy        *HeloPolicy       // Check the name given with HELO and EHLO, nothing is checked if nil
+	Help              map[string]string // Replies to HELP, keyed by upper case topic or "" for HELP alone, in place of the built-in text
+	Hostname          string
+	LogRead           LogFunc
+	LogWrite          LogFunc
+	Logger            Logger                              // Receives protocol I/O and session events, nothing is logged if nil
+	LookupTXT         func(name string) ([]string, error) // DNS TXT lookup for DKIM and ARC public keys, defaults to net.LookupTXT
+	MaxCommandLength  int                                 // Maximum command line length in octets, including CRLF, defaults to 512
+	MaxLineLength     int                                 // Maximum DATA text line length in octets, including CRLF, defaults to 1000
+	MaxSize           int                                 // Maximum message size allowed, in bytes
+	Metrics           *Metrics                            // Collects connection, command, TLS and message statistics if set
+	RejectLongLines   bool                                // Reject messages with text lines over MaxLineLength with 500 5.5.6 once read, instead of accepting them and counting the long lines, see LongLines
+	SenderPolicy      *SenderPolicy                       // Restrict authenticated users to sending as addresses they own
+	Timeout           time.Duration
+	TLSConfig         *tls.Config
+	TLSListener       bool           // Listen for incoming TLS connections only (not recommended as it may reduce compatibility). Ignored if TLS is not configured.
+	TLSRequired       bool           // Require TLS for every command except NOOP, EHLO, STARTTLS, or QUIT as per RFC 3207. Ignored if TLS is not configured.
+	Tracer            Tracer         // Starts spans around sessions, commands, TLS handshakes and handlers, nothing is traced if nil
+	Transcript        TranscriptSink // Records the full transcript of every session if set
+	VerifyRcpt        RcptVerifier   // Called in place of HandlerRcpt if set, replying with the returned error
+	Vrfy              *VrfyPolicy    // Answer VRFY and EXPN commands, which are not implemented if nil
 }
 
 // ConfigureTLS creates a TLS configuration from certificate and key files.
@@ -186,12 +272,57 @@ func (srv *Server) Serve(ln net.Listener) error {
 	}
 }
 
+// Return the maximum command line length.
+func (srv *Server) maxCommandLength() int {
+	if srv.MaxCommandLength > 0 {
+		return srv.MaxCommandLength
+	}
+	return maxCommandLineLength
+}
+
+// Return the maximum DATA text line length.
+func (srv *Server) maxLineLength() int {
+	if srv.MaxLineLength > 0 {
+		return srv.MaxLineLength
+	}
+	return maxTextLineLength
+}
+
+// Return the lines of the 220 greeting, the first starting with the hostname
+// as required by RFC 5321 section 4.2.
+func (srv *Server) banner() []string {
+	if srv.Banner == "" {
+		return []string{srv.Hostname + " " + srv.Appname + " ESMTP Service ready"}
+	}
+	lines := strings.Split(srv.Banner, "\n")
+	lines[0] = srv.Hostname + " " + lines[0]
+	return lines
+}
+
+// Return the lines of the 221 reply to QUIT.
+func (srv *Server) goodbye() []string {
+	if srv.Goodbye == "" {
+		return []string{srv.Hostname + " " + srv.Appname + " ESMTP Service closing transmission channel"}
+	}
+	return strings.Split(srv.Goodbye, "\n")
+}
+
+// Return the function used to look up DKIM and ARC public keys.
+func (srv *Server) lookupTXT() func(name string) ([]string, error) {
+	if srv.LookupTXT != nil {
+		return srv.LookupTXT
+	}
+	return net.LookupTXT
+}
+
 // Create new session from connection.
 func (srv *Server) newSession(conn net.Conn) (s *session) {
 
 	s = &session{
-		srv:  srv,
-		conn: conn,
+		srv:   srv,
+		conn:  conn,
+		id:    newSessionID(),
+		start: time.Now(),
 
 		// textproto is our gateway to DotReader/DotWriter for SMTP lines.
 		// It can add/remove \r\n and the leading/ending DATA dot markers (.)
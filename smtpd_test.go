@@ -2,8 +2,10 @@ package smtpd
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/textproto"
@@ -71,6 +73,24 @@ func cmdCode(t *testing.T, conn net.Conn, cmd string, code int) string {
 	return msg
 }
 
+// Send a message from sender@example.com in a new session, expecting code in
+// reply to it. It is sent to recipient@example.com if no recipients are given.
+func sendMessage(t *testing.T, server *Server, msg string, code int, to ...string) {
+	if len(to) == 0 {
+		to = []string{"recipient@example.com"}
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	for _, rcpt := range to {
+		cmdCode(t, conn, "RCPT TO:<"+rcpt+">", 250)
+	}
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, msg+"\r\n.", code)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
 // Simple tests: connect, send command, then send QUIT.
 // RFC 2821 section 4.1.4 specifies that these commands do not require a prior EHLO,
 // only that clients should send one, so test without EHLO.
@@ -82,7 +102,7 @@ func TestSimpleCommands(t *testing.T) {
 	}{
 		{"NOOP", 250},
 		{"RSET", 250},
-		{"HELP", 502},
+		{"HELP", 214},
 		{"VRFY", 502},
 		{"EXPN", 502},
 		{"TEST", 500}, // Unsupported command
@@ -311,6 +331,92 @@ func TestCmdDATAWithMaxSize(t *testing.T) {
 	conn.Close()
 }
 
+func TestCmdDATALineLength(t *testing.T) {
+	conn := newConn(t, &Server{MaxLineLength: 20, RejectLongLines: true})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+
+	// Lines of 18 octets fit with CRLF.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, strings.Repeat("x", 18)+"\r\n.", 250)
+
+	// Longer lines are rejected once the whole message has been read.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Short line.\r\n"+strings.Repeat("x", 19)+"\r\nMore text.\r\n.", 500)
+
+	// The session continues with the next command.
+	cmdCode(t, conn, "NOOP", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// By default long lines are accepted and counted.
+	var received string
+	var long int
+	conn = newConn(t, &Server{MaxLineLength: 20, HandlerContext: func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		received, long = string(b), LongLines(ctx)
+		return err
+	}})
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, strings.Repeat("x", 30)+"\r\nShort line.\r\n"+strings.Repeat("y", 30)+"\r\n.", 250)
+	if received != strings.Repeat("x", 30)+"\nShort line.\n"+strings.Repeat("y", 30)+"\n" || long != 2 {
+		t.Errorf("received %q with %d long lines", received, long)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestCmdDATAHandlerError(t *testing.T) {
+	conn := newConn(t, &Server{Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		// Reject after reading only the first line.
+		line, _ := bufio.NewReader(body).ReadString('\n')
+		if line == "Subject: Spam\n" {
+			return &Error{Code: 554, EnhancedCode: "5.7.1", Message: "Rejected as spam"}
+		}
+		if line == "Subject: Fail\n" {
+			return errors.New("disk full")
+		}
+		return nil
+	}})
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+
+	// An *Error is sent as the reply once the rest of the message is read.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	if msg := cmdCode(t, conn, "Subject: Spam\r\n\r\nBuy now.\r\nMore text.\r\n.", 554); msg != "5.7.1 Rejected as spam" {
+		t.Errorf("DATA replied %q", msg)
+	}
+
+	// Other errors are temporary failures.
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	if msg := cmdCode(t, conn, "Subject: Fail\r\n\r\nTest message.\r\n.", 451); !strings.HasPrefix(msg, "4.3.0 ") {
+		t.Errorf("DATA replied %q", msg)
+	}
+
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: Test\r\n\r\nTest message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
+func TestMaxCommandLength(t *testing.T) {
+	conn := newConn(t, &Server{MaxCommandLength: 1000})
+	cmdCode(t, conn, "NOOP "+strings.Repeat("x", 600), 250)
+	cmdCode(t, conn, "NOOP "+strings.Repeat("x", 994), 500)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+}
+
 func TestCmdSTARTTLS(t *testing.T) {
 	conn := newConn(t, &Server{})
 	cmdCode(t, conn, "EHLO host.example.com", 250)
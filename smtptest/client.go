@@ -0,0 +1,214 @@
+package smtptest
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reply is a reply from the server.
+type Reply struct {
+	Code     int
+	Enhanced string   // Enhanced status code, e.g. "2.1.0", empty if the reply has none
+	Lines    []string // Text of each line, without the reply code
+}
+
+func (r Reply) String() string {
+	return strconv.Itoa(r.Code) + " " + strings.Join(r.Lines, "\n"+strconv.Itoa(r.Code)+" ")
+}
+
+var enhancedCodeRE = regexp.MustCompile(`^([245]\.\d{1,3}\.\d{1,3})(\s|$)`)
+
+// Step is one command of a scripted dialogue and the reply it expects.
+type Step struct {
+	Send     string // Command line to send
+	Code     int    // Expected reply code
+	Enhanced string // Expected enhanced status code, not checked if empty
+}
+
+// Client is a connection to a Server that fails the test when the server
+// does not reply as expected.
+type Client struct {
+	Banner  Reply         // Greeting sent by the server
+	Timeout time.Duration // Maximum time to wait for each reply, 5 seconds by default
+
+	t    testing.TB
+	srv  *Server
+	conn net.Conn
+	text *textproto.Conn
+}
+
+// Client connects to the server and checks it sends a 220 greeting.
+func (s *Server) Client(t testing.TB) *Client {
+	t.Helper()
+	conn, err := s.Dial()
+	if err != nil {
+		t.Fatalf("smtptest: dial: %v", err)
+	}
+	c := &Client{Timeout: 5 * time.Second, t: t, srv: s, conn: conn, text: textproto.NewConn(conn)}
+	c.Banner = c.read("(banner)")
+	if c.Banner.Code != 220 {
+		t.Fatalf("smtptest: server greeted with %v, want 220", c.Banner)
+	}
+	return c
+}
+
+// Conn returns the underlying connection, which is a *tls.Conn after StartTLS.
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Cmd sends a command line and returns the reply.
+func (c *Client) Cmd(line string) Reply {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		c.t.Fatalf("smtptest: sending %q: %v", line, err)
+	}
+	return c.read(line)
+}
+
+// Expect sends a command line and checks the reply has the given code and,
+// unless enhanced is empty, enhanced status code.
+func (c *Client) Expect(line string, code int, enhanced string) Reply {
+	c.t.Helper()
+	reply := c.Cmd(line)
+	c.check(line, reply, code, enhanced)
+	return reply
+}
+
+// Script runs a dialogue, checking the reply to each step.
+func (c *Client) Script(steps ...Step) {
+	c.t.Helper()
+	for _, step := range steps {
+		c.Expect(step.Send, step.Code, step.Enhanced)
+	}
+}
+
+// Hello sends EHLO and returns the extensions the server offers, with their
+// parameters, keyed by upper case name.
+func (c *Client) Hello(name string) map[string]string {
+	c.t.Helper()
+	reply := c.Expect("EHLO "+name, 250, "")
+	extensions := make(map[string]string)
+	for _, line := range reply.Lines[1:] {
+		fields := strings.SplitN(line, " ", 2)
+		param := ""
+		if len(fields) == 2 {
+			param = fields[1]
+		}
+		extensions[strings.ToUpper(fields[0])] = param
+	}
+	return extensions
+}
+
+// Data sends DATA, expecting 354, then the message body, and returns the
+// final reply. Lines may end in LF or CRLF; leading dots are escaped.
+func (c *Client) Data(body string) Reply {
+	c.t.Helper()
+	c.Expect("DATA", 354, "")
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	w := c.text.DotWriter()
+	_, err := io.WriteString(w, strings.Replace(body, "\r\n", "\n", -1))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		c.t.Fatalf("smtptest: sending message: %v", err)
+	}
+	return c.read("(message)")
+}
+
+// SendMail sends a message, checking the server accepts the sender, every
+// recipient and the message.
+func (c *Client) SendMail(from string, to []string, body string) {
+	c.t.Helper()
+	c.Expect("MAIL FROM:<"+from+">", 250, "")
+	for _, rcpt := range to {
+		c.Expect("RCPT TO:<"+rcpt+">", 250, "")
+	}
+	c.check("(message)", c.Data(body), 250, "")
+}
+
+// StartTLS sends STARTTLS, expecting 220, and performs the TLS handshake
+// trusting the server's throwaway certificate.
+func (c *Client) StartTLS() {
+	c.t.Helper()
+	c.Expect("STARTTLS", 220, "")
+	config := c.srv.ClientTLSConfig()
+	if config == nil {
+		config = &tls.Config{InsecureSkipVerify: true}
+	}
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		c.t.Fatalf("smtptest: TLS handshake: %v", err)
+	}
+	c.conn = conn
+	c.text = textproto.NewConn(conn)
+}
+
+// Quit sends QUIT, expecting 221, and closes the connection.
+func (c *Client) Quit() {
+	c.t.Helper()
+	c.Expect("QUIT", 221, "")
+	c.Close()
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Read a single or multi-line reply.
+func (c *Client) read(sent string) Reply {
+	c.t.Helper()
+	c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	var reply Reply
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			c.t.Fatalf("smtptest: reading reply to %q: %v", sent, err)
+		}
+		if len(line) < 3 || len(line) > 3 && line[3] != ' ' && line[3] != '-' {
+			c.t.Fatalf("smtptest: malformed reply to %q: %q", sent, line)
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			c.t.Fatalf("smtptest: malformed reply to %q: %q", sent, line)
+		}
+		if reply.Lines == nil {
+			reply.Code = code
+			if len(line) > 4 {
+				if m := enhancedCodeRE.FindStringSubmatch(line[4:]); m != nil {
+					reply.Enhanced = m[1]
+				}
+			}
+		}
+		if len(line) > 4 {
+			reply.Lines = append(reply.Lines, line[4:])
+		} else {
+			reply.Lines = append(reply.Lines, "")
+		}
+		if len(line) <= 3 || line[3] != '-' {
+			return reply
+		}
+	}
+}
+
+func (c *Client) check(sent string, reply Reply, code int, enhanced string) {
+	c.t.Helper()
+	if reply.Code != code || enhanced != "" && reply.Enhanced != enhanced {
+		want := strconv.Itoa(code)
+		if enhanced != "" {
+			want += " " + enhanced
+		}
+		c.t.Fatalf("smtptest: %q: got %v, want %s", sent, reply, want)
+	}
+}
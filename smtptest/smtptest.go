@@ -0,0 +1,411 @@
+// Package smtptest provides utilities for testing code that uses package smtpd:
+// an in-process server capturing the messages it accepts, and a client for
+// scripting SMTP dialogues against it.
+package smtptest
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/mail"
+	"sync"
+	"time"
+
+	"github.com/jawr/smtpd"
+)
+
+// Server is an SMTP server listening on a loopback address or an in-memory
+// pipe, for use in tests.
+type Server struct {
+	Addr   string        // Address the server listens on, "pipe" if started with StartPipe
+	Config *smtpd.Server // May be changed before Start, StartTLS or StartPipe is called
+	Inbox  *Inbox        // Messages accepted by the server
+
+	ln      net.Listener
+	pipe    *pipeListener
+	cert    *x509.Certificate
+	served  chan struct{}
+	mu      sync.Mutex
+	conns   map[net.Conn]bool
+	changed chan struct{} // Closed when a connection opens or closes
+}
+
+// NewServer starts and returns a new server listening on 127.0.0.1 which
+// accepts messages for any recipient, records them in its Inbox and then
+// passes them to handler, if not nil. The caller should call Close when
+// finished, to shut it down.
+func NewServer(handler smtpd.Handler) *Server {
+	s := NewUnstartedServer(handler)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new server that is not started, so that its
+// Config can be changed.
+func NewUnstartedServer(handler smtpd.Handler) *Server {
+	return &Server{
+		Config: &smtpd.Server{
+			Appname:  "smtptest",
+			Handler:  handler,
+			Hostname: "localhost",
+		},
+		Inbox:   &Inbox{changed: make(chan struct{})},
+		conns:   make(map[net.Conn]bool),
+		changed: make(chan struct{}),
+	}
+}
+
+// Start starts the server on a TCP port of 127.0.0.1.
+func (s *Server) Start() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen on a port: %v", err))
+	}
+	s.Addr = ln.Addr().String()
+	s.serve(ln)
+}
+
+// StartTLS configures the server with a throwaway certificate for localhost
+// and 127.0.0.1, offering STARTTLS, and starts it on a TCP port of 127.0.0.1.
+// ClientTLSConfig returns a configuration trusting the certificate.
+func (s *Server) StartTLS() {
+	cert, err := newCertificate()
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to create certificate: %v", err))
+	}
+	s.cert = cert.Leaf
+	s.Config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.Start()
+}
+
+// StartPipe starts the server without a network listener. Connections made
+// with Dial or Client use net.Pipe.
+func (s *Server) StartPipe() {
+	s.pipe = newPipeListener()
+	s.Addr = "pipe"
+	s.serve(s.pipe)
+}
+
+func (s *Server) serve(ln net.Listener) {
+	if s.ln != nil {
+		panic("smtptest: server already started")
+	}
+	s.ln = ln
+	s.served = make(chan struct{})
+	// The session calls HandlerContext in place of Handler if it is set.
+	if s.Config.HandlerContext != nil {
+		s.Config.HandlerContext = s.Inbox.captureContext(s.Config.HandlerContext)
+	} else {
+		s.Config.Handler = s.Inbox.capture(s.Config.Handler)
+	}
+
+	go func() {
+		s.Config.Serve(&trackingListener{ln, s})
+		close(s.served)
+	}()
+}
+
+// Close stops the server, closing any open connections.
+func (s *Server) Close() {
+	if s.ln == nil {
+		return
+	}
+	s.ln.Close()
+	<-s.served
+
+	// Closing a connection untracks it, so close them without holding mu.
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Dial connects to the server.
+func (s *Server) Dial() (net.Conn, error) {
+	if s.pipe != nil {
+		return s.pipe.dial()
+	}
+	return net.Dial("tcp", s.Addr)
+}
+
+// ClientTLSConfig returns a TLS configuration trusting the certificate
+// generated by StartTLS. It is nil if the server was not started with StartTLS.
+func (s *Server) ClientTLSConfig() *tls.Config {
+	if s.cert == nil {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(s.cert)
+	return &tls.Config{RootCAs: pool, ServerName: "localhost"}
+}
+
+// WaitIdle waits until every connection to the server has been closed.
+func (s *Server) WaitIdle(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		open, changed := len(s.conns), s.changed
+		s.mu.Unlock()
+		if open == 0 {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return fmt.Errorf("smtptest: %d connections still open after %v", open, timeout)
+		}
+	}
+}
+
+// Record that conn has opened or closed.
+func (s *Server) track(conn net.Conn, open bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if open {
+		s.conns[conn] = true
+	} else if s.conns[conn] {
+		delete(s.conns, conn)
+	} else {
+		return
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// trackingListener records the connections the server accepts.
+type trackingListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn = &trackedConn{Conn: conn, srv: l.srv}
+	l.srv.track(conn, true)
+	return conn, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	srv *Server
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.srv.track(c, false)
+	return err
+}
+
+var errListenerClosed = errors.New("smtptest: listener closed")
+
+// pipeListener hands out the server ends of net.Pipe connections.
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// Message is a message accepted by the server.
+type Message struct {
+	RemoteAddr net.Addr
+	From       string   // Reverse path, empty for bounces
+	To         []string // Accepted recipients
+	Data       []byte   // Message as passed to the handler, with LF line endings
+}
+
+// Header returns the parsed header of the message, or nil if it is malformed.
+func (m *Message) Header() mail.Header {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return nil
+	}
+	return msg.Header
+}
+
+// Body returns the message after the header.
+func (m *Message) Body() []byte {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Data))
+	if err != nil {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	return body
+}
+
+// Inbox holds the messages accepted by a Server, in order.
+type Inbox struct {
+	mu       sync.Mutex
+	messages []*Message
+	changed  chan struct{} // Closed when a message arrives
+}
+
+// Messages returns the messages accepted so far.
+func (ib *Inbox) Messages() []*Message {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return append([]*Message(nil), ib.messages...)
+}
+
+// Len returns the number of messages accepted so far.
+func (ib *Inbox) Len() int {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	return len(ib.messages)
+}
+
+// Reset discards the messages accepted so far.
+func (ib *Inbox) Reset() {
+	ib.mu.Lock()
+	ib.messages = nil
+	ib.mu.Unlock()
+}
+
+// Wait waits until at least n messages have been accepted and returns them.
+func (ib *Inbox) Wait(n int, timeout time.Duration) ([]*Message, error) {
+	deadline := time.After(timeout)
+	for {
+		ib.mu.Lock()
+		messages, changed := ib.messages, ib.changed
+		ib.mu.Unlock()
+		if len(messages) >= n {
+			return append([]*Message(nil), messages...), nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return append([]*Message(nil), messages...), fmt.Errorf("smtptest: %d messages received after %v, want %d", len(messages), timeout, n)
+		}
+	}
+}
+
+// Return a handler reading the message and passing it to next, recording it
+// if next accepts it.
+func (ib *Inbox) capture(next smtpd.Handler) smtpd.Handler {
+	return func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if next != nil {
+			if err := next(remoteAddr, from, to, bytes.NewReader(data)); err != nil {
+				return err
+			}
+		}
+		ib.add(&Message{RemoteAddr: remoteAddr, From: from, To: append([]string(nil), to...), Data: data})
+		return nil
+	}
+}
+
+// Return a HandlerContext reading the message and passing it to next,
+// recording it if next accepts it.
+func (ib *Inbox) captureContext(next smtpd.HandlerContext) smtpd.HandlerContext {
+	return func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		if err := next(ctx, remoteAddr, from, to, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		ib.add(&Message{RemoteAddr: remoteAddr, From: from, To: append([]string(nil), to...), Data: data})
+		return nil
+	}
+}
+
+// Record an accepted message.
+func (ib *Inbox) add(msg *Message) {
+	ib.mu.Lock()
+	ib.messages = append(ib.messages, msg)
+	close(ib.changed)
+	ib.changed = make(chan struct{})
+	ib.mu.Unlock()
+}
+
+// Generate a self-signed certificate for localhost.
+func newCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"smtptest"}},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,125 @@
+package smtptest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	srv := NewServer(nil)
+	defer srv.Close()
+
+	c := srv.Client(t)
+	if !strings.HasPrefix(c.Banner.Lines[0], "localhost smtptest ESMTP") {
+		t.Errorf("banner is %v", c.Banner)
+	}
+	if _, ok := c.Hello("client.example.com")["ENHANCEDSTATUSCODES"]; !ok {
+		t.Error("ENHANCEDSTATUSCODES not offered")
+	}
+	c.SendMail("sender@example.com", []string{"a@example.com", "b@example.com"}, "Subject: Hello\n\n.Leading dot\n")
+	c.Quit()
+
+	messages, err := srv.Inbox.Wait(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := messages[0]
+	if msg.From != "sender@example.com" || strings.Join(msg.To, ",") != "a@example.com,b@example.com" {
+		t.Errorf("envelope is %q %q", msg.From, msg.To)
+	}
+	if msg.Header().Get("Subject") != "Hello" || string(msg.Body()) != ".Leading dot\n" {
+		t.Errorf("message is %q", msg.Data)
+	}
+	if err := srv.WaitIdle(time.Second); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerHandlerContext(t *testing.T) {
+	srv := NewUnstartedServer(nil)
+	var queued string
+	srv.Config.HandlerContext = func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		queued = string(b)
+		return err
+	}
+	srv.StartPipe()
+	defer srv.Close()
+
+	c := srv.Client(t)
+	c.Hello("client.example.com")
+	c.SendMail("sender@example.com", []string{"a@example.com"}, "Subject: Hello\n\nHi.\n")
+	c.Quit()
+
+	messages, err := srv.Inbox.Wait(1, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(messages[0].Data) != queued || queued != "Subject: Hello\n\nHi.\n" {
+		t.Errorf("captured %q, handler received %q", messages[0].Data, queued)
+	}
+}
+
+func TestServerPipe(t *testing.T) {
+	srv := NewUnstartedServer(func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		if _, err := ioutil.ReadAll(body); err != nil {
+			return err
+		}
+		if from == "spam@example.com" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+	srv.Config.MaxSize = 100
+	srv.StartPipe()
+	defer srv.Close()
+
+	c := srv.Client(t)
+	c.Script(
+		Step{"HELO client.example.com", 250, ""},
+		Step{"RCPT TO:<a@example.com>", 503, "5.5.1"},
+		Step{"MAIL FROM:<spam@example.com> SIZE=1000", 552, "5.3.4"},
+		Step{"MAIL FROM:<spam@example.com>", 250, "2.1.0"},
+		Step{"RCPT TO:<a@example.com>", 250, "2.1.5"},
+	)
+	if reply := c.Data("Subject: Spam\n\nBuy now.\n"); reply.Code != 451 || reply.Enhanced != "4.3.0" {
+		t.Errorf("handler error replied %v", reply)
+	}
+	c.Quit()
+
+	if srv.Inbox.Len() != 0 {
+		t.Errorf("rejected message captured: %q", srv.Inbox.Messages()[0].Data)
+	}
+	if _, err := srv.Inbox.Wait(1, 10*time.Millisecond); err == nil {
+		t.Error("Wait returned without a message")
+	}
+}
+
+func TestServerStartTLS(t *testing.T) {
+	srv := NewUnstartedServer(nil)
+	srv.Config.TLSRequired = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	c := srv.Client(t)
+	if _, ok := c.Hello("client.example.com")["STARTTLS"]; !ok {
+		t.Fatal("STARTTLS not offered")
+	}
+	c.Expect("MAIL FROM:<sender@example.com>", 530, "5.7.0")
+	c.StartTLS()
+	if _, ok := c.Hello("client.example.com")["STARTTLS"]; ok {
+		t.Error("STARTTLS offered after TLS handshake")
+	}
+	c.SendMail("sender@example.com", []string{"a@example.com"}, "Subject: Secret\n\nHello.\n")
+	c.Quit()
+
+	if _, err := srv.Inbox.Wait(1, time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
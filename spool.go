@@ -0,0 +1,556 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolState is the state of a message in a Spool.
+type SpoolState string
+
+// Spool states.
+const (
+	SpoolQueued SpoolState = "queued" // Waiting for delivery, or being delivered
+	SpoolHeld   SpoolState = "held"   // Not delivered until retried
+	SpoolDead   SpoolState = "dead"   // Delivery failed permanently or too many times
+)
+
+// SpoolEntry describes a message in a Spool.
+type SpoolEntry struct {
+	ID          string            `json:"id"`
+	State       SpoolState        `json:"state"`
+	From        string            `json:"from"`
+	To          []string          `json:"to"`
+	RemoteAddr  string            `json:"remote_addr"`
+	Received    time.Time         `json:"received"`
+	Size        int64             `json:"size"`
+	Attempts    int               `json:"attempts"`             // Failed delivery attempts
+	NextAttempt time.Time         `json:"next_attempt"`         // Time of the next delivery attempt if queued
+	LastError   string            `json:"last_error,omitempty"` // Error returned by the last delivery attempt
+	Params      map[string]string `json:"params,omitempty"`     // ESMTP parameters given with MAIL, such as RET and ENVID
+}
+
+// Spool is a durable on-disk queue. Its Enqueue method is a HandlerContext
+// that accepts messages once they are safely on disk, replying with their
+// queue ID, and a pool of workers delivers them to Handler in the background.
+//
+// Each message is stored in Dir as <id>.msg, with its SpoolEntry in
+// <id>.json. Both are fsynced before the message is accepted and updated by
+// atomic renames, so a crash loses nothing that was accepted; a message being
+// delivered when the process stops is delivered again after Start.
+//
+// Handler errors are retried with exponential backoff. An *Error with a 5xx
+// code, or failing MaxAttempts times, moves the message to the SpoolDead
+// state, where it stays until it is retried or deleted. Its sender is sent a
+// delivery status notification, queued in the spool with a null
+// reverse-path, unless the message itself had one (RFC 5321 section 6.1).
+type Spool struct {
+	Dir         string        // Directory holding the queue, created if missing
+	Hostname    string        // Reporting MTA of delivery status notifications, defaults to the system hostname
+	Handler     Handler       // Delivers queued messages
+	Workers     int           // Number of concurrent deliveries, defaults to 4
+	MaxAttempts int           // Delivery attempts before giving up, defaults to 10
+	Backoff     time.Duration // Delay before the first retry, doubled for each further one, defaults to 1 minute
+	MaxBackoff  time.Duration // Maximum delay between retries, defaults to 4 hours
+	Logger      Logger        // Receives delivery results, nothing is logged if nil
+
+	mu       sync.Mutex
+	entries  map[string]*SpoolEntry
+	inflight map[string]bool
+	work     chan *SpoolEntry
+	wake     chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+var (
+	errSpoolNotStarted = errors.New("spool not started")
+	errSpoolStarted    = errors.New("spool already started")
+	errSpoolBusy       = errors.New("message is being delivered")
+)
+
+type queueIDKey struct{}
+
+// SetQueueID sets the queue ID of a message accepted by a HandlerContext,
+// which is included in the server's 250 reply.
+func SetQueueID(ctx context.Context, id string) {
+	if p, ok := ctx.Value(queueIDKey{}).(*string); ok {
+		*p = id
+	}
+}
+
+// spoolAddr is the remote address of a queued message.
+type spoolAddr string
+
+func (a spoolAddr) Network() string { return "tcp" }
+func (a spoolAddr) String() string  { return string(a) }
+
+// Start loads the queue from disk and starts delivering messages. A closed
+// spool can be started again once Close has returned.
+func (sp *Spool) Start() error {
+	sp.mu.Lock()
+	running := sp.stop != nil
+	sp.mu.Unlock()
+	if running {
+		return errSpoolStarted
+	}
+
+	tmp := filepath.Join(sp.Dir, "tmp")
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return err
+	}
+	// Files left in tmp belong to messages that were never accepted.
+	names, err := filepath.Glob(filepath.Join(tmp, "*"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+
+	entries := make(map[string]*SpoolEntry)
+	names, err = filepath.Glob(filepath.Join(sp.Dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		entry := new(SpoolEntry)
+		if err := json.Unmarshal(b, entry); err != nil {
+			return fmt.Errorf("spool: %s: %v", name, err)
+		}
+		entries[entry.ID] = entry
+	}
+	// A message without an entry was never accepted, or was being deleted.
+	names, err = filepath.Glob(filepath.Join(sp.Dir, "*.msg"))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if entries[strings.TrimSuffix(filepath.Base(name), ".msg")] == nil {
+			os.Remove(name)
+		}
+	}
+
+	sp.mu.Lock()
+	if sp.stop != nil {
+		sp.mu.Unlock()
+		return errSpoolStarted
+	}
+	stop := make(chan struct{})
+	sp.entries = entries
+	sp.inflight = make(map[string]bool)
+	sp.work = make(chan *SpoolEntry)
+	sp.wake = make(chan struct{}, 1)
+	sp.stop = stop
+	work := sp.work
+	sp.mu.Unlock()
+
+	workers := sp.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	sp.wg.Add(workers + 1)
+	go sp.schedule(work, stop)
+	for i := 0; i < workers; i++ {
+		go sp.worker(work)
+	}
+	return nil
+}
+
+// Close stops delivering messages, waiting for deliveries in progress.
+func (sp *Spool) Close() error {
+	sp.mu.Lock()
+	stop := sp.stop
+	sp.stop = nil
+	sp.mu.Unlock()
+	if stop == nil {
+		return errSpoolNotStarted
+	}
+	close(stop)
+	sp.wg.Wait()
+	return nil
+}
+
+// Enqueue writes the message to the spool and sets its queue ID with
+// SetQueueID. The MAIL parameters of the session are kept for notifications.
+func (sp *Spool) Enqueue(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	sp.mu.Lock()
+	started := sp.entries != nil
+	sp.mu.Unlock()
+	if !started {
+		return errSpoolNotStarted
+	}
+
+	entry := newSpoolEntry(remoteAddr.String(), from, to)
+	if info := SessionFromContext(ctx); info != nil && len(info.MailParams) > 0 {
+		entry.Params = make(map[string]string, len(info.MailParams))
+		for k, v := range info.MailParams {
+			entry.Params[k] = v
+		}
+	}
+	if err := sp.add(entry, body); err != nil {
+		return err
+	}
+	SetQueueID(ctx, entry.ID)
+	return nil
+}
+
+// Return the entry of a new message.
+func newSpoolEntry(remoteAddr, from string, to []string) *SpoolEntry {
+	now := time.Now().UTC()
+	return &SpoolEntry{
+		ID:          newSessionID(),
+		State:       SpoolQueued,
+		From:        from,
+		To:          to,
+		RemoteAddr:  remoteAddr,
+		Received:    now,
+		NextAttempt: now,
+	}
+}
+
+// Write a new message to disk and queue it.
+func (sp *Spool) add(entry *SpoolEntry, body io.Reader) error {
+	tmp := filepath.Join(sp.Dir, "tmp", entry.ID+".msg")
+	size, err := writeFile(tmp, "", body, true)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	entry.Size = size
+	if err := os.Rename(tmp, sp.path(entry.ID, ".msg")); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := sp.save(entry); err != nil {
+		os.Remove(sp.path(entry.ID, ".msg"))
+		return err
+	}
+
+	sp.log(LogInfo, "message queued", entry)
+	sp.mu.Lock()
+	sp.entries[entry.ID] = entry
+	sp.mu.Unlock()
+	sp.signal()
+	return nil
+}
+
+// List returns the messages in the given state, or all messages if state is
+// empty, oldest first.
+func (sp *Spool) List(state SpoolState) []SpoolEntry {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	var list []SpoolEntry
+	for _, entry := range sp.entries {
+		if state == "" || entry.State == state {
+			list = append(list, *entry)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].Received.Equal(list[j].Received) {
+			return list[i].Received.Before(list[j].Received)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Open returns the content of a message.
+func (sp *Spool) Open(id string) (io.ReadCloser, error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.entries[id] == nil {
+		return nil, fmt.Errorf("spool: no message %q", id)
+	}
+	return os.Open(sp.path(id, ".msg"))
+}
+
+// Retry queues a message for immediate delivery. A dead message starts again
+// with no failed attempts.
+func (sp *Spool) Retry(id string) error {
+	return sp.update(id, func(entry *SpoolEntry) {
+		if entry.State == SpoolDead {
+			entry.Attempts = 0
+		}
+		entry.State = SpoolQueued
+		entry.NextAttempt = time.Now().UTC()
+	})
+}
+
+// Hold stops a message from being delivered until it is retried.
+func (sp *Spool) Hold(id string) error {
+	return sp.update(id, func(entry *SpoolEntry) {
+		entry.State = SpoolHeld
+	})
+}
+
+// Delete removes a message from the spool.
+func (sp *Spool) Delete(id string) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if _, err := sp.entry(id); err != nil {
+		return err
+	}
+	if err := sp.remove(id); err != nil {
+		return err
+	}
+	delete(sp.entries, id)
+	return nil
+}
+
+// Return the entry of a message which is not being delivered. Called with mu held.
+func (sp *Spool) entry(id string) (*SpoolEntry, error) {
+	entry := sp.entries[id]
+	if entry == nil {
+		return nil, fmt.Errorf("spool: no message %q", id)
+	}
+	if sp.inflight[id] {
+		return nil, errSpoolBusy
+	}
+	return entry, nil
+}
+
+// Change the entry of a message which is not being delivered, and save it.
+func (sp *Spool) update(id string, change func(entry *SpoolEntry)) error {
+	sp.mu.Lock()
+	entry, err := sp.entry(id)
+	if err == nil {
+		updated := *entry
+		change(&updated)
+		if err = sp.save(&updated); err == nil {
+			*entry = updated
+		}
+	}
+	sp.mu.Unlock()
+	sp.signal()
+	return err
+}
+
+// Return the path of a message file with the given extension.
+func (sp *Spool) path(id, ext string) string {
+	return filepath.Join(sp.Dir, id+ext)
+}
+
+// Write an entry to disk, replacing the previous version atomically.
+func (sp *Spool) save(entry *SpoolEntry) error {
+	b, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(sp.Dir, "tmp", entry.ID+".json")
+	if _, err := writeFile(tmp, "", bytes.NewReader(append(b, '\n')), true); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, sp.path(entry.ID, ".json")); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(sp.Dir, true)
+}
+
+// Remove the files of a message, its entry first so that a crash does not
+// leave an entry without a message.
+func (sp *Spool) remove(id string) error {
+	if err := os.Remove(sp.path(id, ".json")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(sp.path(id, ".msg")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return syncDir(sp.Dir, true)
+}
+
+// Wake the scheduler after the queue changes.
+func (sp *Spool) signal() {
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Hand queued messages to the workers as they become due.
+func (sp *Spool) schedule(work chan<- *SpoolEntry, stop <-chan struct{}) {
+	defer sp.wg.Done()
+	defer close(work)
+	for {
+		// Find the queued message due first.
+		sp.mu.Lock()
+		var next *SpoolEntry
+		for _, entry := range sp.entries {
+			if entry.State == SpoolQueued && !sp.inflight[entry.ID] &&
+				(next == nil || entry.NextAttempt.Before(next.NextAttempt)) {
+				next = entry
+			}
+		}
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if next != nil {
+			if d := time.Until(next.NextAttempt); d > 0 {
+				timer = time.NewTimer(d)
+				wait = timer.C
+				next = nil
+			} else {
+				sp.inflight[next.ID] = true
+			}
+		}
+		sp.mu.Unlock()
+
+		if next != nil {
+			select {
+			case work <- next:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		select {
+		case <-wait:
+		case <-sp.wake:
+		case <-stop:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// Deliver messages handed over by the scheduler.
+func (sp *Spool) worker(work <-chan *SpoolEntry) {
+	defer sp.wg.Done()
+	for entry := range work {
+		sp.deliver(entry)
+	}
+}
+
+// Attempt to deliver a message, then remove it or schedule the next attempt.
+// The message stays in flight until its files are updated, so the entry is
+// only changed by this worker and the file work is done without holding mu.
+func (sp *Spool) deliver(entry *SpoolEntry) {
+	f, err := os.Open(sp.path(entry.ID, ".msg"))
+	if err == nil {
+		if sp.Handler == nil {
+			_, err = io.Copy(ioutil.Discard, f)
+		} else {
+			err = sp.Handler(spoolAddr(entry.RemoteAddr), entry.From, entry.To, f)
+		}
+		f.Close()
+	}
+	defer sp.signal()
+
+	if err == nil {
+		if err := sp.remove(entry.ID); err != nil {
+			sp.log(LogError, "removing delivered message failed", entry, "error", err)
+		}
+		sp.mu.Lock()
+		delete(sp.inflight, entry.ID)
+		delete(sp.entries, entry.ID)
+		sp.mu.Unlock()
+		sp.log(LogInfo, "message delivered", entry)
+		return
+	}
+
+	updated := *entry
+	updated.Attempts++
+	updated.LastError = err.Error()
+	if serr, ok := err.(*Error); ok && serr.Code >= 500 || updated.Attempts >= sp.maxAttempts() {
+		updated.State = SpoolDead
+		sp.log(LogWarn, "message dead", &updated, "error", err)
+	} else {
+		updated.NextAttempt = time.Now().UTC().Add(sp.backoff(updated.Attempts))
+		sp.log(LogWarn, "message deferred", &updated, "error", err, "next_attempt", updated.NextAttempt)
+	}
+	if err := sp.save(&updated); err != nil {
+		sp.log(LogError, "saving message state failed", entry, "error", err)
+	}
+	if updated.State == SpoolDead && updated.From != "" {
+		if err := sp.bounce(&updated, err); err != nil {
+			sp.log(LogError, "queueing delivery status notification failed", entry, "error", err)
+		}
+	}
+
+	// Keep the state in memory even if it could not be saved, so the message
+	// is not retried at once.
+	sp.mu.Lock()
+	*entry = updated
+	delete(sp.inflight, entry.ID)
+	sp.mu.Unlock()
+}
+
+// Queue a delivery status notification telling the sender of a dead message
+// that delivery failed with err.
+func (sp *Spool) bounce(entry *SpoolEntry, err error) error {
+	msg, rerr := ioutil.ReadFile(sp.path(entry.ID, ".msg"))
+	if rerr != nil {
+		return rerr
+	}
+	hostname := sp.Hostname
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	serr, ok := err.(*Error)
+	if !ok {
+		serr = &Error{Code: 451, EnhancedCode: "4.3.0", Message: err.Error()}
+	}
+	dsn := newDSN(hostname, entry.From, entry.Params, msg)
+	dsn.ArrivalDate = entry.Received
+	for _, rcpt := range entry.To {
+		dsn.Recipients = append(dsn.Recipients, RelayFailure{Rcpt: rcpt, Err: serr}.DSNRecipient())
+	}
+	return sp.add(newSpoolEntry("", "", []string{entry.From}), bytes.NewReader(dsn.Bytes()))
+}
+
+func (sp *Spool) maxAttempts() int {
+	if sp.MaxAttempts > 0 {
+		return sp.MaxAttempts
+	}
+	return 10
+}
+
+// Return the delay before the next attempt after the given number of failures.
+func (sp *Spool) backoff(attempts int) time.Duration {
+	d, max := sp.Backoff, sp.MaxBackoff
+	if d <= 0 {
+		d = time.Minute
+	}
+	if max <= 0 {
+		max = 4 * time.Hour
+	}
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Log an entry for a queued message.
+func (sp *Spool) log(level LogLevel, msg string, entry *SpoolEntry, keyvals ...interface{}) {
+	if sp.Logger == nil {
+		return
+	}
+	fields := []interface{}{"queue_id", entry.ID, "from", entry.From, "rcpts", len(entry.To), "attempts", entry.Attempts}
+	sp.Logger.Log(level, msg, append(fields, keyvals...)...)
+}
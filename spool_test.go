@@ -0,0 +1,168 @@
+package smtpd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wait until the spool holds n messages in the given state.
+func waitSpool(t *testing.T, sp *Spool, state SpoolState, n int) []SpoolEntry {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		list := sp.List(state)
+		if len(list) == n {
+			return list
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("spool has %d %s messages, want %d: %+v", len(list), state, n, sp.List(""))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	delivered := make(chan string, 10)
+	bounces := make(chan string, 10)
+	sp := &Spool{
+		Dir:         dir,
+		Hostname:    "mx.example.com",
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			switch {
+			case from == "":
+				bounces <- strings.Join(to, ",") + " " + string(b)
+				return nil
+			case strings.Contains(string(b), "Permanent"):
+				return &Error{Code: 550, EnhancedCode: "5.1.1", Message: "No such user"}
+			case strings.Contains(string(b), "Temporary"):
+				return errors.New("connection refused")
+			}
+			delivered <- string(b)
+			return nil
+		},
+	}
+	if err := sp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{HandlerContext: sp.Enqueue}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	msg := cmdCode(t, conn, "Subject: Test\r\n\r\nHello.\r\n.", 250)
+	if !strings.HasPrefix(msg, "2.0.0 Ok: queued as ") {
+		t.Errorf("message accepted with %q", msg)
+	}
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	select {
+	case body := <-delivered:
+		if body != "Subject: Test\n\nHello.\n" {
+			t.Errorf("delivered %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message not delivered")
+	}
+	waitSpool(t, sp, "", 0)
+
+	// Permanent errors and repeated temporary errors are dead-lettered, and
+	// the sender notified as asked with RET and ENVID.
+	conn = newConn(t, server)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com> RET=FULL ENVID=QQ314159", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Subject: Permanent\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+	if dead := waitSpool(t, sp, SpoolDead, 1); dead[0].Attempts != 1 || !strings.HasPrefix(dead[0].LastError, "550 5.1.1 ") {
+		t.Errorf("permanent failure recorded as %+v", dead[0])
+	}
+	sendMessage(t, server, "Subject: Temporary", 250)
+	waitSpool(t, sp, SpoolDead, 2)
+	if dead := sp.List(SpoolDead); dead[1].Attempts != 3 || dead[1].LastError != "connection refused" {
+		t.Errorf("temporary failure recorded as %+v", dead[1])
+	}
+	for _, want := range [][]string{
+		{"Original-Envelope-Id: QQ314159\n", "Status: 5.1.1\nDiagnostic-Code: smtp; 550 5.1.1 No such user\n", "Content-Type: message/rfc822\n"},
+		{"Status: 4.3.0\nDiagnostic-Code: smtp; 451 4.3.0 connection refused\n", "Content-Type: text/rfc822-headers\n"},
+	} {
+		select {
+		case body := <-bounces:
+			if !strings.HasPrefix(body, "sender@example.com From: Mail Delivery System <MAILER-DAEMON@mx.example.com>\n") {
+				t.Errorf("bounce is %q", body)
+			}
+			for _, s := range want {
+				if !strings.Contains(body, s) {
+					t.Errorf("bounce %q does not contain %q", body, s)
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("bounce not delivered")
+		}
+	}
+	waitSpool(t, sp, SpoolQueued, 0)
+
+	// Held messages survive a restart and are delivered when retried.
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Close(); err != errSpoolNotStarted {
+		t.Errorf("second Close() returned %v", err)
+	}
+	sp.Handler = func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+		b, err := ioutil.ReadAll(body)
+		if err == nil {
+			delivered <- remoteAddr.String() + " " + string(b)
+		}
+		return err
+	}
+	if err := sp.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	if err := sp.Start(); err != errSpoolStarted {
+		t.Errorf("second Start() returned %v", err)
+	}
+	dead := waitSpool(t, sp, SpoolDead, 2)
+	if err := sp.Hold(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Delete(dead[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	waitSpool(t, sp, SpoolHeld, 1)
+	if err := sp.Retry(dead[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-delivered:
+		if body != dead[0].RemoteAddr+" Subject: Permanent\n" {
+			t.Errorf("delivered %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("retried message not delivered")
+	}
+	waitSpool(t, sp, "", 0)
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("spool directory holds %d files, want only tmp", len(files))
+	}
+}
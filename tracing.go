@@ -0,0 +1,209 @@
+package smtpd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Span names used by the server.
+const (
+	SpanSession      = "smtp.session"       // The whole connection
+	SpanCommand      = "smtp.command"       // One command and its reply
+	SpanTLSHandshake = "smtp.tls_handshake" // STARTTLS or TLS listener handshake
+	SpanHandler      = "smtp.handler"       // Message filters and Handler or HandlerContext
+)
+
+// Tracer starts the spans the server creates around sessions, commands, TLS
+// handshakes and handlers. Attributes are given as alternating key/value pairs,
+// e.g. "smtp.remote_ip", "smtp.helo", "smtp.from", "smtp.rcpt_count",
+// "smtp.bytes" and "smtp.reply_code". The returned context carries the span and
+// is the parent of spans started from it, so an adapter for a tracing library
+// such as OpenTelemetry only needs to start a span of its own and return the
+// context it gets back.
+type Tracer interface {
+	Start(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span)
+}
+
+// Span is an operation started by a Tracer.
+type Span interface {
+	SetAttributes(keyvals ...interface{})
+	RecordError(err error)
+	End()
+}
+
+// HandlerContext is called in place of Handler if set. ctx carries the
+// handler's span, and is cancelled when the handler returns.
+type HandlerContext func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error
+
+type spanKey struct{}
+
+// SpanFromContext returns the span started by the server that ctx carries, or
+// a span that does nothing.
+func SpanFromContext(ctx context.Context) Span {
+	if span, ok := ctx.Value(spanKey{}).(Span); ok {
+		return span
+	}
+	return nopSpan{}
+}
+
+// SessionInfo describes the session a message was received in.
+type SessionInfo struct {
+	ID           string               // Session identifier used in logs
+	RemoteAddr   net.Addr             // Address of the client
+	LocalAddr    net.Addr             // Address the client connected to
+	RemoteHost   string               // Client hostname according to reverse DNS lookup
+	Helo         string               // Hostname the client gave with HELO or EHLO
+	HeloFailures []string             // HeloPolicy checks the Helo name failed that are set to HeloScore
+	TLS          *tls.ConnectionState // nil if the connection is not encrypted
+	MailParams   map[string]string    // ESMTP parameters given with MAIL for the message, see HandlerMail
+	User         string               // User the client sent the message as according to SenderPolicy, if any
+}
+
+type sessionKey struct{}
+
+type longLinesKey struct{}
+
+// LongLines returns the number of text lines over Server.MaxLineLength read so
+// far from the message passed to the HandlerContext the context belongs to.
+// It is final once the body has been read to the end, which message filters
+// such as DKIM signing do before the handler is called.
+func LongLines(ctx context.Context) int {
+	if lines, ok := ctx.Value(longLinesKey{}).(*lineLimitReader); ok {
+		return lines.long
+	}
+	return 0
+}
+
+// SessionFromContext returns the session that the context passed to
+// HandlerContext belongs to, or nil.
+func SessionFromContext(ctx context.Context) *SessionInfo {
+	info, _ := ctx.Value(sessionKey{}).(*SessionInfo)
+	return info
+}
+
+// Return a description of the session.
+func (s *session) info() *SessionInfo {
+	info := &SessionInfo{ID: s.id, RemoteAddr: s.conn.RemoteAddr(), LocalAddr: s.conn.LocalAddr(), RemoteHost: s.remoteHost, Helo: s.remoteName, HeloFailures: s.heloFailures, MailParams: s.params, User: s.user}
+	if tlsConn, ok := s.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLS = &state
+	}
+	return info
+}
+
+// nopTracer is used by servers without a Tracer.
+type nopTracer struct{}
+
+func (nopTracer) Start(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(keyvals ...interface{}) {}
+func (nopSpan) RecordError(err error)                {}
+func (nopSpan) End()                                 {}
+
+// Return the tracer for the server.
+func (srv *Server) tracer() Tracer {
+	if srv.Tracer != nil {
+		return srv.Tracer
+	}
+	return nopTracer{}
+}
+
+// Start a span for the session as a child of the span in ctx.
+func (s *session) startSpan(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span) {
+	ctx, span := s.srv.tracer().Start(ctx, name, keyvals...)
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Start the span for a command, ending any previous one.
+func (s *session) startCommand(verb string) {
+	s.endCommand()
+	if !metricVerbs[verb] {
+		verb = "UNKNOWN"
+	}
+	s.cmdCtx, s.cmdSpan = s.startSpan(s.ctx, SpanCommand, "smtp.command", verb)
+}
+
+// End the span of the current command, if any.
+func (s *session) endCommand() {
+	if s.cmdSpan != nil {
+		s.cmdSpan.End()
+		s.cmdCtx, s.cmdSpan = nil, nil
+	}
+}
+
+// Return the context of the current command, or the session's.
+func (s *session) context() context.Context {
+	if s.cmdCtx != nil {
+		return s.cmdCtx
+	}
+	return s.ctx
+}
+
+// SpanRecorder is a Tracer keeping spans in memory, for use in tests.
+type SpanRecorder struct {
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span started by a SpanRecorder.
+type RecordedSpan struct {
+	Name       string
+	Parent     *RecordedSpan // nil for the root span
+	Attributes map[string]interface{}
+	Errors     []error
+	StartTime  time.Time
+	EndTime    time.Time // Zero until the span has ended
+
+	rec *SpanRecorder
+}
+
+// Start records a new span, a child of the RecordedSpan in ctx if any.
+func (r *SpanRecorder) Start(ctx context.Context, name string, keyvals ...interface{}) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(*RecordedSpan)
+	span := &RecordedSpan{Name: name, Parent: parent, Attributes: make(map[string]interface{}), StartTime: time.Now(), rec: r}
+	span.SetAttributes(keyvals...)
+
+	r.mu.Lock()
+	r.spans = append(r.spans, span)
+	r.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Spans returns the spans started so far, in order.
+func (r *SpanRecorder) Spans() []*RecordedSpan {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*RecordedSpan(nil), r.spans...)
+}
+
+// SetAttributes sets the given key/value pairs.
+func (s *RecordedSpan) SetAttributes(keyvals ...interface{}) {
+	s.rec.mu.Lock()
+	defer s.rec.mu.Unlock()
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		s.Attributes[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+}
+
+// RecordError records err.
+func (s *RecordedSpan) RecordError(err error) {
+	s.rec.mu.Lock()
+	s.Errors = append(s.Errors, err)
+	s.rec.mu.Unlock()
+}
+
+// End sets the end time of the span.
+func (s *RecordedSpan) End() {
+	s.rec.mu.Lock()
+	s.EndTime = time.Now()
+	s.rec.mu.Unlock()
+}
@@ -0,0 +1,71 @@
+package smtpd
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	logger := newTestLogger()
+	recorder := &SpanRecorder{}
+	var handlerSpan Span
+	server := &Server{
+		Logger: logger,
+		Tracer: recorder,
+		HandlerContext: func(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			handlerSpan = SpanFromContext(ctx)
+			_, err := io.Copy(ioutil.Discard, body)
+			return err
+		},
+	}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, conn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, conn, "DATA", 354)
+	cmdCode(t, conn, "Test message.\r\n.", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+	<-logger.closed
+
+	spans := recorder.Spans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+		if span.EndTime.IsZero() {
+			t.Errorf("span %s did not end", span.Name)
+		}
+	}
+	want := []string{SpanSession, SpanCommand, SpanCommand, SpanCommand, SpanCommand, SpanHandler, SpanCommand}
+	if len(names) != len(want) {
+		t.Fatalf("recorded spans %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("recorded spans %q, want %q", names, want)
+		}
+	}
+
+	session, data, handler := spans[0], spans[4], spans[5]
+	if _, ok := session.Attributes["smtp.remote_ip"]; !ok || session.Parent != nil || session.Attributes["smtp.helo"] != "host.example.com" ||
+		session.Attributes["smtp.close_reason"] != "quit" {
+		t.Errorf("session span %+v", session)
+	}
+	if data.Parent != session || data.Attributes["smtp.command"] != "DATA" || data.Attributes["smtp.reply_code"] != "250" {
+		t.Errorf("DATA span %+v", data)
+	}
+	if handler.Parent != data || handler.Attributes["smtp.from"] != "sender@example.com" ||
+		handler.Attributes["smtp.rcpt_count"] != 1 || handler.Attributes["smtp.bytes"] != 14 {
+		t.Errorf("handler span %+v", handler)
+	}
+	if handlerSpan != handler {
+		t.Errorf("handler context carried span %+v", handlerSpan)
+	}
+	if mail := spans[2]; mail.Attributes["smtp.from"] != "sender@example.com" {
+		t.Errorf("MAIL span %+v", mail)
+	}
+}
@@ -0,0 +1,416 @@
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TranscriptKind identifies what a transcript entry records.
+type TranscriptKind string
+
+// Kinds of transcript entries.
+const (
+	TranscriptOpen  TranscriptKind = "open"  // Connection accepted, Text is the remote address
+	TranscriptRead  TranscriptKind = "read"  // Line read from the client, AUTH credentials redacted
+	TranscriptWrite TranscriptKind = "write" // Line written to the client
+	TranscriptTLS   TranscriptKind = "tls"   // TLS handshake completed, Text is the version and cipher suite
+	TranscriptData  TranscriptKind = "data"  // Part of a message body, with dot-stuffing removed and LF line endings
+	TranscriptClose TranscriptKind = "close" // Connection closed, Text is the reason
+)
+
+// TranscriptEntry is one event in a session transcript.
+type TranscriptEntry struct {
+	Time      time.Time      `json:"time"`
+	Kind      TranscriptKind `json:"kind"`
+	Text      string         `json:"text,omitempty"`
+	Truncated bool           `json:"truncated,omitempty"` // The rest of the message body, or of a line too long to read, was not recorded
+}
+
+// TranscriptSink records complete session transcripts. Start is called when a
+// connection is accepted; if it fails the session continues unrecorded.
+type TranscriptSink interface {
+	Start(sessionID string, remoteAddr net.Addr) (TranscriptWriter, error)
+}
+
+// TranscriptWriter receives the entries of one session, in order, followed by
+// a call to Close. If Record fails the session stops recording.
+type TranscriptWriter interface {
+	Record(entry TranscriptEntry) error
+	Close() error
+}
+
+// TranscriptDir is a TranscriptSink writing each session to its own file in
+// Dir, named after the start time and session ID, with one JSON encoded
+// TranscriptEntry per line.
+type TranscriptDir struct {
+	Dir     string
+	MaxData int // Maximum bytes of each message body recorded; 0 records bodies in full, negative omits them
+}
+
+// Start creates the transcript file for a session.
+func (d *TranscriptDir) Start(sessionID string, remoteAddr net.Addr) (TranscriptWriter, error) {
+	name := time.Now().UTC().Format("20060102T150405") + "-" + sessionID + ".transcript"
+	f, err := os.OpenFile(filepath.Join(d.Dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &fileTranscript{f: f, w: w, enc: json.NewEncoder(w), maxData: d.MaxData}, nil
+}
+
+type fileTranscript struct {
+	f         *os.File
+	w         *bufio.Writer
+	enc       *json.Encoder
+	maxData   int
+	dataBytes int  // Bytes of the current message body recorded so far
+	truncated bool // The current message body has been truncated
+}
+
+func (t *fileTranscript) Record(entry TranscriptEntry) error {
+	if entry.Kind != TranscriptData {
+		t.dataBytes = 0
+		t.truncated = false
+		return t.enc.Encode(entry)
+	}
+	if t.maxData == 0 {
+		return t.enc.Encode(entry)
+	}
+
+	// Record bodies up to maxData, then mark them truncated once.
+	if t.truncated {
+		return nil
+	}
+	limit := t.maxData
+	if limit < 0 {
+		limit = 0
+	}
+	if t.dataBytes+len(entry.Text) > limit {
+		entry.Text = entry.Text[:limit-t.dataBytes]
+		entry.Truncated = true
+		t.truncated = true
+	}
+	t.dataBytes += len(entry.Text)
+	return t.enc.Encode(entry)
+}
+
+func (t *fileTranscript) Close() error {
+	err := t.w.Flush()
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadTranscript parses a transcript written by TranscriptDir.
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	dec := json.NewDecoder(r)
+	for {
+		var entry TranscriptEntry
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// Start recording the session if the server has a TranscriptSink.
+func (s *session) startTranscript() {
+	if s.srv.Transcript == nil {
+		return
+	}
+	w, err := s.srv.Transcript.Start(s.id, s.conn.RemoteAddr())
+	if err != nil {
+		s.log(LogWarn, "transcript failed", "error", err)
+		return
+	}
+	s.transcript = w
+	s.record(TranscriptOpen, s.conn.RemoteAddr().String())
+}
+
+// Record a transcript entry, giving up on the transcript if it fails.
+func (s *session) record(kind TranscriptKind, text string) {
+	s.recordEntry(TranscriptEntry{Kind: kind, Text: text})
+}
+
+// Record a transcript entry at the current time.
+func (s *session) recordEntry(entry TranscriptEntry) {
+	if s.transcript == nil {
+		return
+	}
+	entry.Time = time.Now()
+	if err := s.transcript.Record(entry); err != nil {
+		s.log(LogWarn, "transcript failed", "error", err)
+		s.transcript.Close()
+		s.transcript = nil
+	}
+}
+
+// Record the reason the session ended and close the transcript.
+func (s *session) closeTranscript(reason string) {
+	s.record(TranscriptClose, reason)
+	if s.transcript != nil {
+		if err := s.transcript.Close(); err != nil {
+			s.log(LogWarn, "transcript failed", "error", err)
+		}
+		s.transcript = nil
+	}
+}
+
+// transcriptBody records a message body as the handler reads it.
+type transcriptBody struct {
+	s *session
+}
+
+func (b transcriptBody) Write(p []byte) (int, error) {
+	b.s.record(TranscriptData, string(p))
+	return len(p), nil
+}
+
+// ReplayDiff is a reply that changed when a transcript was replayed.
+type ReplayDiff struct {
+	Command string   // Line sent by the client, "" for the banner, "DATA body" or "TLS handshake"
+	Want    []string // Reply lines in the transcript
+	Got     []string // Reply lines sent by the server during the replay, nil if there were none
+}
+
+// CodeChanged reports whether the reply code differs, ignoring the text.
+func (d ReplayDiff) CodeChanged() bool {
+	return replyCode(d.Want) != replyCode(d.Got)
+}
+
+func (d ReplayDiff) String() string {
+	command := d.Command
+	if command == "" {
+		command = "(banner)"
+	}
+	var b strings.Builder
+	b.WriteString(command + "\n")
+	for _, line := range d.Want {
+		b.WriteString("- " + line + "\n")
+	}
+	for _, line := range d.Got {
+		b.WriteString("+ " + line + "\n")
+	}
+	return b.String()
+}
+
+func replyCode(lines []string) string {
+	if len(lines) == 0 || len(lines[0]) < 3 {
+		return ""
+	}
+	return lines[0][:3]
+}
+
+// How long replay waits for each reply from the server.
+const replayTimeout = 5 * time.Second
+
+// A client action in a transcript and the reply recorded for it.
+type replayStep struct {
+	kind      TranscriptKind // TranscriptOpen, TranscriptRead, TranscriptData or TranscriptTLS
+	text      string
+	truncated bool // A line too long to be read whole
+	reply     []string
+}
+
+// Group transcript entries into client actions and their replies.
+func replaySteps(entries []TranscriptEntry) []*replayStep {
+	steps := []*replayStep{{kind: TranscriptOpen}}
+	cur := steps[0]
+	for _, e := range entries {
+		switch e.Kind {
+		case TranscriptOpen:
+			cur.text = e.Text
+		case TranscriptWrite:
+			cur.reply = append(cur.reply, e.Text)
+		case TranscriptData:
+			if cur.kind != TranscriptData {
+				cur = &replayStep{kind: TranscriptData}
+				steps = append(steps, cur)
+			}
+			cur.text += e.Text
+		case TranscriptRead, TranscriptTLS:
+			cur = &replayStep{kind: e.Kind, text: e.Text, truncated: e.Truncated}
+			steps = append(steps, cur)
+		}
+	}
+	return steps
+}
+
+func (step *replayStep) command() string {
+	switch step.kind {
+	case TranscriptOpen:
+		return ""
+	case TranscriptData:
+		return "DATA body"
+	case TranscriptTLS:
+		return "TLS handshake"
+	}
+	return step.text
+}
+
+// conn reporting the remote address recorded in the transcript.
+type replayConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c replayConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// Replay feeds a transcript written by TranscriptDir back into srv over an
+// in-memory connection, as if the client had connected from the recorded
+// address, and returns the replies that differ from the recorded ones. It is
+// intended for regression testing policy changes. Message bodies are sent as
+// recorded, so truncated bodies are replayed truncated. Command lines that
+// were too long are padded to exceed both the recorded length and srv's
+// MaxCommandLength.
+func Replay(srv *Server, transcript io.Reader) ([]ReplayDiff, error) {
+	entries, err := ReadTranscript(transcript)
+	if err != nil {
+		return nil, err
+	}
+	steps := replaySteps(entries)
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	var conn net.Conn = serverConn
+	if addr, err := net.ResolveTCPAddr("tcp", steps[0].text); err == nil {
+		conn = replayConn{serverConn, addr}
+	}
+	// A TLS handshake before the banner means the client used a TLS listener.
+	implicitTLS := len(steps) > 1 && steps[1].kind == TranscriptTLS
+	if implicitTLS {
+		if srv.TLSConfig == nil {
+			return nil, errors.New("transcript requires TLS but the server has no TLSConfig")
+		}
+		conn = tls.Server(conn, srv.TLSConfig)
+	}
+	go srv.newSession(conn).serve()
+
+	var client net.Conn = clientConn
+	tpconn := textproto.NewConn(client)
+	var diffs []ReplayDiff
+	var last []string // Most recent reply from the server
+	for i, step := range steps {
+		client.SetDeadline(time.Now().Add(replayTimeout))
+
+		switch step.kind {
+		case TranscriptOpen:
+			if implicitTLS {
+				continue
+			}
+		case TranscriptRead:
+			line := step.text
+			if step.truncated {
+				// The limit counts the line ending.
+				n := len(line) + 1
+				if max := srv.maxCommandLength() - 1; n < max {
+					n = max
+				}
+				line += strings.Repeat("x", n-len(line))
+			}
+			err = tpconn.PrintfLine("%s", line)
+		case TranscriptData:
+			if replyCode(last) != "354" {
+				diffs = append(diffs, ReplayDiff{Command: step.command(), Want: step.reply})
+				continue
+			}
+			w := tpconn.DotWriter()
+			if _, err = io.WriteString(w, step.text); err == nil {
+				err = w.Close()
+			}
+		case TranscriptTLS:
+			if !(implicitTLS && i == 1) && replyCode(last) != "220" {
+				continue
+			}
+			tlsConn := tls.Client(client, &tls.Config{InsecureSkipVerify: true})
+			if err := tlsConn.Handshake(); err != nil {
+				return diffs, fmt.Errorf("TLS handshake: %v", err)
+			}
+			client = tlsConn
+			tpconn = textproto.NewConn(client)
+		}
+		if err != nil {
+			return append(diffs, remainingDiffs(steps[i:])...), nil
+		}
+
+		// Every action but STARTTLS's handshake has a reply.
+		if step.kind == TranscriptTLS && !(implicitTLS && i == 1) {
+			continue
+		}
+		last, err = readReply(tpconn)
+		if !equalLines(step.reply, last) {
+			diffs = append(diffs, ReplayDiff{Command: step.command(), Want: step.reply, Got: last})
+		}
+		if err != nil {
+			return append(diffs, remainingDiffs(steps[i+1:])...), nil
+		}
+
+		// The server now expects a body the transcript doesn't have.
+		if replyCode(last) == "354" && (i+1 == len(steps) || steps[i+1].kind != TranscriptData) {
+			client.SetDeadline(time.Now().Add(replayTimeout))
+			if err = tpconn.DotWriter().Close(); err == nil {
+				last, err = readReply(tpconn)
+			}
+			diffs = append(diffs, ReplayDiff{Command: "DATA body", Got: last})
+			if err != nil {
+				return append(diffs, remainingDiffs(steps[i+1:])...), nil
+			}
+		}
+	}
+	return diffs, nil
+}
+
+// Read a single or multi-line reply.
+func readReply(tpconn *textproto.Conn) (lines []string, err error) {
+	for {
+		line, err := tpconn.ReadLine()
+		if err != nil {
+			return lines, err
+		}
+		lines = append(lines, line)
+		if len(line) < 4 || line[3] != '-' {
+			return lines, nil
+		}
+	}
+}
+
+// The recorded replies the server never sent because the connection closed.
+func remainingDiffs(steps []*replayStep) (diffs []ReplayDiff) {
+	for _, step := range steps {
+		if len(step.reply) > 0 {
+			diffs = append(diffs, ReplayDiff{Command: step.command(), Want: step.reply})
+		}
+	}
+	return diffs
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
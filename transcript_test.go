@@ -0,0 +1,290 @@
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Record a session with STARTTLS and a message, returning the transcript file.
+func recordTranscript(t *testing.T, dir string, maxData int) string {
+	logger := newTestLogger()
+	server := &Server{
+		Hostname:   "mx.example.com",
+		Logger:     logger,
+		TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+		Transcript: &TranscriptDir{Dir: dir, MaxData: maxData},
+	}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "STARTTLS", 220)
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("Failed to perform TLS handshake: %v", err)
+	}
+	cmdCode(t, tlsConn, "EHLO host.example.com", 250)
+	cmdCode(t, tlsConn, "MAIL FROM:<sender@example.com>", 250)
+	cmdCode(t, tlsConn, "RCPT TO:<recipient@example.com>", 250)
+	cmdCode(t, tlsConn, "DATA", 354)
+	cmdCode(t, tlsConn, "Subject: Test\r\n\r\n..leading dot\r\n.", 250)
+	cmdCode(t, tlsConn, "QUIT", 221)
+	tlsConn.Close()
+	<-logger.closed
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.transcript"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("found transcripts %q: %v", files, err)
+	}
+	return files[0]
+}
+
+func TestTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Open(recordTranscript(t, dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ReadTranscript(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	var body string
+	for _, e := range entries {
+		if e.Time.IsZero() {
+			t.Errorf("entry %+v has no time", e)
+		}
+		if len(kinds) == 0 || kinds[len(kinds)-1] != string(e.Kind) {
+			kinds = append(kinds, string(e.Kind))
+		}
+		if e.Kind == TranscriptData {
+			body += e.Text
+		}
+	}
+	want := "open write read write read write tls read write read write read write read write data write read write close"
+	if got := strings.Join(kinds, " "); got != want {
+		t.Errorf("transcript kinds are\n%s, want\n%s", got, want)
+	}
+	if body != "Subject: Test\n\n.leading dot\n" {
+		t.Errorf("transcript body is %q", body)
+	}
+	if last := entries[len(entries)-1]; last.Text != "quit" {
+		t.Errorf("transcript closed with %q, want quit", last.Text)
+	}
+}
+
+func TestTranscriptMaxData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Open(recordTranscript(t, dir, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := ReadTranscript(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var body string
+	truncated := 0
+	for _, e := range entries {
+		if e.Kind == TranscriptData {
+			body += e.Text
+			if e.Truncated {
+				truncated++
+			}
+		}
+	}
+	if body != "Subject:" || truncated != 1 {
+		t.Errorf("truncated body is %q, marked %d times", body, truncated)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	transcript, err := ioutil.ReadFile(recordTranscript(t, dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	server := &Server{
+		Hostname:  "mx.example.com",
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			received = string(b)
+			return err
+		},
+	}
+
+	// The same configuration replies identically.
+	diffs, err := Replay(server, strings.NewReader(string(transcript)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("replay returned differences %v", diffs)
+	}
+	if received != "Subject: Test\n\n.leading dot\n" {
+		t.Errorf("replayed body is %q", received)
+	}
+
+	// A stricter policy rejects the recipient, so the body is never sent.
+	server.HandlerRcpt = func(remoteAddr net.Addr, from string, to string) bool { return false }
+	diffs, err = Replay(server, strings.NewReader(string(transcript)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands []string
+	for _, d := range diffs {
+		if !d.CodeChanged() {
+			t.Errorf("difference without a code change: %v", d)
+		}
+		commands = append(commands, d.Command)
+	}
+	if got := strings.Join(commands, ", "); got != "RCPT TO:<recipient@example.com>, DATA, DATA body" {
+		t.Errorf("replay differed in %s, diffs %v", got, diffs)
+	}
+}
+
+// The rest of a message rejected before the handler read all of it is
+// recorded too, so replays send the whole body.
+func TestReplayRejected(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := newTestLogger()
+	rejected := &Error{Code: 554, EnhancedCode: "5.7.1", Message: "Rejected"}
+	server := &Server{
+		Hostname:   "mx.example.com",
+		Logger:     logger,
+		Transcript: &TranscriptDir{Dir: dir},
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			body.Read(make([]byte, 8))
+			return rejected
+		},
+	}
+	msg := "Subject: Test\r\n\r\n" + strings.Repeat("A line of the body.\r\n", 100)
+	sendMessage(t, server, strings.TrimSuffix(msg, "\r\n"), 554)
+	<-logger.closed
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.transcript"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("found transcripts %q: %v", files, err)
+	}
+	transcript, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received string
+	server = &Server{
+		Hostname: "mx.example.com",
+		Handler: func(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+			b, err := ioutil.ReadAll(body)
+			received = string(b)
+			if err != nil {
+				return err
+			}
+			return rejected
+		},
+	}
+	diffs, err := Replay(server, strings.NewReader(string(transcript)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 0 {
+		t.Errorf("replay returned differences %v", diffs)
+	}
+	if want := strings.Replace(msg, "\r\n", "\n", -1); received != want {
+		t.Errorf("replayed body is %q, want %q", received, want)
+	}
+}
+
+// Command lines too long to read are recorded truncated, and replayed so that
+// their reply is not attached to the previous command.
+func TestReplayLongLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logger := newTestLogger()
+	server := &Server{
+		Hostname:         "mx.example.com",
+		Logger:           logger,
+		MaxCommandLength: 40,
+		Transcript:       &TranscriptDir{Dir: dir},
+	}
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	cmdCode(t, conn, "MAIL FROM:<"+strings.Repeat("x", 40)+"@example.com>", 500)
+	cmdCode(t, conn, "NOOP", 250)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+	<-logger.closed
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.transcript"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("found transcripts %q: %v", files, err)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadTranscript(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reads []string
+	for _, e := range entries {
+		if e.Kind == TranscriptRead {
+			reads = append(reads, fmt.Sprintf("%s %v", e.Text, e.Truncated))
+		}
+	}
+	want := "EHLO host.example.com false, MAIL FROM:<" + strings.Repeat("x", 29) + " true, NOOP false, QUIT false"
+	if got := strings.Join(reads, ", "); got != want {
+		t.Errorf("recorded reads %q, want %q", got, want)
+	}
+
+	transcript, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The line is still too long for servers with a higher limit.
+	for _, limit := range []int{40, 0} {
+		server = &Server{Hostname: "mx.example.com", MaxCommandLength: limit}
+		if diffs, err := Replay(server, strings.NewReader(string(transcript))); err != nil || len(diffs) != 0 {
+			t.Errorf("replay with limit %d returned differences %v, %v", limit, diffs, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VrfyPolicy answers the VRFY and EXPN commands (RFC 5321 section 3.5). As
+// they let clients harvest addresses, they are only answered for clients
+// allowed by the policy, and may be rate limited.
+type VrfyPolicy struct {
+	// Verify returns the mailboxes matching the user name or address given
+	// with VRFY, as "user@example.com" or "Name <user@example.com>". One
+	// mailbox is replied to with 250, several with 553 listing them. Return an
+	// *Error for other replies, e.g. 550 5.1.1 for an unknown user, 251 for one
+	// that is not local or 252 for one that cannot be verified. VRFY is not
+	// implemented if nil.
+	Verify func(query string) ([]string, error)
+
+	// Expand returns the members of the mailing list given with EXPN, in the
+	// same form. EXPN is not implemented if nil.
+	Expand func(list string) ([]string, error)
+
+	Authenticated bool          // Only answer clients authenticated by the Server's SenderPolicy
+	Networks      []*net.IPNet  // Only answer clients in these networks, if any
+	Limit         int           // Maximum number of commands answered per client IP address in Interval, unlimited if zero
+	Interval      time.Duration // Rate limiting interval, defaults to one minute
+
+	mu     sync.Mutex
+	counts map[string]*vrfyCount // Commands answered per client IP address
+}
+
+// Maximum number of client IP addresses rate limited at once. Commands from
+// further addresses are refused until the counts of others expire.
+const maxVrfyClients = 10000
+
+// Commands answered for a client IP address since start.
+type vrfyCount struct {
+	start time.Time
+	n     int
+}
+
+// Return whether the policy answers the command.
+func (p *VrfyPolicy) implements(verb string) bool {
+	if p == nil {
+		return false
+	}
+	if verb == "EXPN" {
+		return p.Expand != nil
+	}
+	return p.Verify != nil
+}
+
+// Return whether the client of the session may use VRFY and EXPN.
+func (p *VrfyPolicy) allowed(s *session) bool {
+	if p.Authenticated && (s.srv.SenderPolicy == nil || s.srv.SenderPolicy.User(s.info()) == "") {
+		return false
+	}
+	if len(p.Networks) == 0 {
+		return true
+	}
+	ip := net.ParseIP(s.remoteIP)
+	for _, n := range p.Networks {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Count a command from the IP address, returning false if over the limit.
+func (p *VrfyPolicy) take(ip string) bool {
+	if p.Limit <= 0 {
+		return true
+	}
+	interval := p.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.counts == nil {
+		p.counts = make(map[string]*vrfyCount)
+	}
+	c := p.counts[ip]
+	if c == nil || now.Sub(c.start) >= interval {
+		if len(p.counts) >= 1000 {
+			for ip, c := range p.counts {
+				if now.Sub(c.start) >= interval {
+					delete(p.counts, ip)
+				}
+			}
+		}
+		if c == nil && len(p.counts) >= maxVrfyClients {
+			return false
+		}
+		c = &vrfyCount{start: now}
+		p.counts[ip] = c
+	}
+	c.n++
+	return c.n <= p.Limit
+}
+
+// Reply to a VRFY or EXPN command.
+func (s *session) vrfy(verb, args string) {
+	p := s.srv.Vrfy
+	arg := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(args), "<"), ">")
+	if arg == "" {
+		s.writef("501 5.5.4 Syntax error in parameters or arguments")
+		return
+	}
+	if !p.allowed(s) {
+		s.log(LogWarn, strings.ToLower(verb)+" rejected", "query", arg, "error", "not allowed")
+		s.writef("550 5.7.1 Command rejected: not allowed")
+		return
+	}
+	if !p.take(s.remoteIP) {
+		s.log(LogWarn, strings.ToLower(verb)+" rejected", "query", arg, "error", "rate limited")
+		s.writef("450 4.7.1 Too many requests, try again later")
+		return
+	}
+
+	lookup := p.Verify
+	if verb == "EXPN" {
+		lookup = p.Expand
+	}
+	mailboxes, err := lookup(arg)
+	if err == nil && len(mailboxes) == 0 {
+		err = &Error{Code: 550, EnhancedCode: "5.1.1", Message: "User unknown"}
+	}
+	if err != nil {
+		s.log(LogInfo, strings.ToLower(verb), "query", arg, "error", err)
+		if serr, ok := err.(*Error); ok {
+			s.replyError(serr)
+		} else {
+			s.writef("451 4.3.0 Requested action aborted: local error in processing")
+		}
+		return
+	}
+	s.log(LogInfo, strings.ToLower(verb), "query", arg, "results", len(mailboxes))
+
+	lines := make([]string, len(mailboxes))
+	for i, mailbox := range mailboxes {
+		if !strings.Contains(mailbox, "<") {
+			mailbox = "<" + mailbox + ">"
+		}
+		lines[i] = mailbox
+	}
+	if verb == "VRFY" && len(lines) > 1 {
+		s.reply(553, "5.1.4", append([]string{"User ambiguous; possibilities are"}, lines...)...)
+		return
+	}
+	s.reply(250, "2.1.5", lines...)
+}
@@ -0,0 +1,99 @@
+package smtpd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVrfy(t *testing.T) {
+	recipients := &RecipientMap{Entries: map[string][]string{
+		"alice@example.com": nil,
+		"alex@example.com":  nil,
+		"team@example.com":  {"alice@example.com", "alex@example.com"},
+	}}
+	vrfy := &VrfyPolicy{
+		Verify: func(query string) ([]string, error) {
+			switch query {
+			case "al":
+				return []string{"Alice <alice@example.com>", "Alex <alex@example.com>"}, nil
+			case "remote@example.net":
+				return nil, &Error{Code: 252, EnhancedCode: "2.1.5", Message: "Cannot VRFY user, but will attempt delivery"}
+			}
+			return recipients.Resolve(query)
+		},
+		Expand: recipients.Resolve,
+		Limit:  6,
+	}
+	server := &Server{Vrfy: vrfy}
+
+	conn := newConn(t, server)
+	cmdCode(t, conn, "EHLO host.example.com", 250)
+	if msg := cmdCode(t, conn, "VRFY <Alice@example.com>", 250); msg != "2.1.5 <alice@example.com>" {
+		t.Errorf("VRFY replied %q", msg)
+	}
+	if msg := cmdCode(t, conn, "VRFY al", 553); msg != "5.1.4 User ambiguous; possibilities are\n5.1.4 Alice <alice@example.com>\n5.1.4 Alex <alex@example.com>" {
+		t.Errorf("VRFY replied %q", msg)
+	}
+	cmdCode(t, conn, "VRFY remote@example.net", 252)
+	cmdCode(t, conn, "VRFY bob@example.com", 550)
+	if msg := cmdCode(t, conn, "EXPN team@example.com", 250); msg != "2.1.5 <alice@example.com>\n2.1.5 <alex@example.com>" {
+		t.Errorf("EXPN replied %q", msg)
+	}
+	cmdCode(t, conn, "VRFY", 501)
+	cmdCode(t, conn, "EXPN bob@example.com", 550)
+	cmdCode(t, conn, "VRFY alice@example.com", 450)
+	cmdCode(t, conn, "QUIT", 221)
+	conn.Close()
+
+	// Clients are restricted by network and authentication.
+	_, local, _ := net.ParseCIDR("127.0.0.0/8")
+	vrfy.Limit = 0
+	vrfy.Networks = []*net.IPNet{local}
+	conn = newConn(t, server)
+	cmdCode(t, conn, "VRFY alice@example.com", 550)
+	conn.Close()
+
+	vrfy.Networks = nil
+	vrfy.Authenticated = true
+	conn = newConn(t, server)
+	cmdCode(t, conn, "VRFY alice@example.com", 550)
+	conn.Close()
+	server.SenderPolicy = &SenderPolicy{User: func(info *SessionInfo) string { return "alice" }}
+	conn = newConn(t, server)
+	cmdCode(t, conn, "VRFY alice@example.com", 250)
+	conn.Close()
+
+	// EXPN is not implemented without Expand.
+	vrfy.Expand = nil
+	conn = newConn(t, server)
+	cmdCode(t, conn, "EXPN team@example.com", 502)
+	conn.Close()
+
+	// Nor is VRFY without Verify.
+	server.Vrfy = &VrfyPolicy{Expand: func(list string) ([]string, error) { return []string{"alice@example.com"}, nil }}
+	conn = newConn(t, server)
+	cmdCode(t, conn, "VRFY alice@example.com", 502)
+	if msg := cmdCode(t, conn, "HELP", 214); strings.Contains(msg, "VRFY") || !strings.Contains(msg, "EXPN") {
+		t.Errorf("HELP replied %q", msg)
+	}
+	cmdCode(t, conn, "EXPN team@example.com", 250)
+	conn.Close()
+}
+
+func TestVrfyLimitClients(t *testing.T) {
+	p := &VrfyPolicy{Limit: 1, Interval: time.Hour}
+	for i := 0; i < maxVrfyClients; i++ {
+		if !p.take(strconv.Itoa(i)) {
+			t.Fatalf("client %d refused", i)
+		}
+	}
+	if p.take("new") {
+		t.Error("client over the limit accepted")
+	}
+	if len(p.counts) != maxVrfyClients {
+		t.Errorf("%d clients counted", len(p.counts))
+	}
+}
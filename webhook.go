@@ -0,0 +1,285 @@
+package smtpd
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookFormat is the request body sent by Webhook.
+type WebhookFormat int
+
+// Webhook request formats.
+const (
+	WebhookRaw       WebhookFormat = iota // The message as message/rfc822, with the envelope in X-Smtpd-From, X-Smtpd-To and X-Smtpd-Remote-Addr headers
+	WebhookJSON                           // A WebhookMessage as application/json
+	WebhookMultipart                      // multipart/form-data with the WebhookMessage fields, and attachments as files
+)
+
+// Webhook posts messages to an HTTP endpoint. Its Deliver method is a Handler.
+//
+// A 2xx response accepts the message. Other 4xx responses, except 408 and
+// 429, reject it with 554 5.6.0. Network errors and other responses are
+// retried, then the message is rejected with 451 4.3.0 so the client tries
+// again later.
+//
+// Attempts and the delays between them stop once MaxElapsed has passed, so
+// the client waits at most MaxElapsed, 60 seconds by default, for the reply
+// after sending the message.
+//
+// If Secret is set, each request is signed: X-Smtpd-Timestamp holds the Unix
+// time and X-Smtpd-Signature the hex HMAC-SHA256 of the timestamp, a "." and
+// the request body, as computed by WebhookSignature.
+type Webhook struct {
+	URL        string
+	Format     WebhookFormat
+	Secret     []byte        // HMAC key for signing requests
+	Header     http.Header   // Added to each request, e.g. for an Authorization header
+	Client     *http.Client  // Defaults to http.DefaultClient
+	Timeout    time.Duration // Maximum time for each attempt, defaults to 30 seconds
+	Retries    int           // Further attempts after a temporary failure, defaults to 2; negative for none
+	RetryDelay time.Duration // Delay before the first retry, doubled for each further one, defaults to 1 second
+	MaxElapsed time.Duration // Maximum time for all attempts together, defaults to 60 seconds
+}
+
+// WebhookMessage is the message as sent in the WebhookJSON and
+// WebhookMultipart formats.
+type WebhookMessage struct {
+	From        string              `json:"from"`
+	To          []string            `json:"to"`
+	RemoteAddr  string              `json:"remote_addr"`
+	Headers     map[string][]string `json:"headers"`
+	Subject     string              `json:"subject"` // Decoded
+	Text        string              `json:"text,omitempty"`
+	HTML        string              `json:"html,omitempty"`
+	Attachments []WebhookAttachment `json:"attachments,omitempty"`
+}
+
+// WebhookAttachment is a MIME part of a message other than its text and HTML
+// bodies.
+type WebhookAttachment struct {
+	Filename    string `json:"filename,omitempty"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"` // Decoded, base64 encoded in JSON
+}
+
+// WebhookSignature returns the signature sent in the X-Smtpd-Signature header,
+// for receivers to check against.
+func WebhookSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp+".")
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliver posts the message to the webhook.
+func (wh *Webhook) Deliver(remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	return wh.DeliverContext(context.Background(), remoteAddr, from, to, body)
+}
+
+// DeliverContext posts the message to the webhook, giving up when ctx is done.
+// It is a HandlerContext.
+func (wh *Webhook) DeliverContext(ctx context.Context, remoteAddr net.Addr, from string, to []string, body io.Reader) error {
+	msg, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	addr := ""
+	if remoteAddr != nil {
+		addr = remoteAddr.String()
+	}
+
+	var contentType string
+	var reqBody []byte
+	switch wh.Format {
+	case WebhookJSON:
+		m, err := parseWebhookMessage(from, to, addr, msg)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+		reqBody, err = json.Marshal(m)
+		if err != nil {
+			return err
+		}
+	case WebhookMultipart:
+		m, err := parseWebhookMessage(from, to, addr, msg)
+		if err != nil {
+			return err
+		}
+		if contentType, reqBody, err = m.multipart(); err != nil {
+			return err
+		}
+	default:
+		contentType = "message/rfc822"
+		reqBody = msg
+	}
+
+	retries := wh.Retries
+	if retries == 0 {
+		retries = 2
+	}
+	delay := wh.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	maxElapsed := wh.MaxElapsed
+	if maxElapsed <= 0 {
+		maxElapsed = 60 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, maxElapsed)
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		err = wh.post(ctx, contentType, reqBody, from, to, addr)
+		if serr, ok := err.(*Error); err == nil || ok && serr.Code >= 500 || attempt >= retries {
+			return err
+		}
+		// Do not wait for a retry there is no time left for.
+		if deadline, _ := ctx.Deadline(); time.Until(deadline) <= delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Make one attempt at posting the request body.
+func (wh *Webhook) post(ctx context.Context, contentType string, body []byte, from string, to []string, remoteAddr string) error {
+	req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range wh.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	if wh.Format == WebhookRaw {
+		req.Header.Set("X-Smtpd-From", from)
+		req.Header.Set("X-Smtpd-To", strings.Join(to, ", "))
+		req.Header.Set("X-Smtpd-Remote-Addr", remoteAddr)
+	}
+	if wh.Secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Smtpd-Timestamp", timestamp)
+		req.Header.Set("X-Smtpd-Signature", WebhookSignature(wh.Secret, timestamp, body))
+	}
+
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	timeout := wh.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Webhook failed: " + err.Error()}
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Message rejected: " + resp.Status}
+	}
+	return &Error{Code: 451, EnhancedCode: "4.3.0", Message: "Webhook failed: " + resp.Status}
+}
+
+// Parse a message into its header, text and HTML bodies and attachments.
+func parseWebhookMessage(from string, to []string, remoteAddr string, msg []byte) (*WebhookMessage, error) {
+	wm := &WebhookMessage{From: from, To: to, RemoteAddr: remoteAddr}
+	p := &MessageParser{}
+	p.Header = func(header textproto.MIMEHeader) error {
+		wm.Headers = header
+		wm.Subject = p.DecodeHeader(header.Get("Subject"))
+		return nil
+	}
+	p.Part = func(part *MessagePart) error {
+		content, err := ioutil.ReadAll(part.Body)
+		if err != nil {
+			return err
+		}
+		disposition, _, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+		if disposition != "attachment" && part.Filename == "" && part.Charset == "utf-8" {
+			if part.MediaType == "text/plain" && wm.Text == "" {
+				wm.Text = string(content)
+				return nil
+			}
+			if part.MediaType == "text/html" && wm.HTML == "" {
+				wm.HTML = string(content)
+				return nil
+			}
+		}
+		wm.Attachments = append(wm.Attachments, WebhookAttachment{Filename: part.Filename, ContentType: part.MediaType, Content: content})
+		return nil
+	}
+	if err := p.Parse(bytes.NewReader(msg)); err != nil {
+		if _, ok := err.(*Error); !ok {
+			err = &Error{Code: 554, EnhancedCode: "5.6.0", Message: "Malformed message: " + err.Error()}
+		}
+		return nil, err
+	}
+	return wm, nil
+}
+
+// Return the message as multipart/form-data.
+func (wm *WebhookMessage) multipart() (string, []byte, error) {
+	var b bytes.Buffer
+	w := multipart.NewWriter(&b)
+	headers, err := json.Marshal(wm.Headers)
+	if err != nil {
+		return "", nil, err
+	}
+	w.WriteField("from", wm.From)
+	for _, rcpt := range wm.To {
+		w.WriteField("to", rcpt)
+	}
+	w.WriteField("remote_addr", wm.RemoteAddr)
+	w.WriteField("headers", string(headers))
+	w.WriteField("subject", wm.Subject)
+	w.WriteField("text", wm.Text)
+	w.WriteField("html", wm.HTML)
+	for i, a := range wm.Attachments {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+			"name":     "attachment" + strconv.Itoa(i+1),
+			"filename": a.Filename,
+		}))
+		h.Set("Content-Type", a.ContentType)
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return "", nil, err
+		}
+		part.Write(a.Content)
+	}
+	if err := w.Close(); err != nil {
+		return "", nil, err
+	}
+	return w.FormDataContentType(), b.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+package smtpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var webhookTestMessage = "From: Sender <sender@example.com>\n" +
+	"Subject: =?utf-8?q?Caf=C3=A9?=\n" +
+	"MIME-Version: 1.0\n" +
+	"Content-Type: multipart/mixed; boundary=outer\n\n" +
+	"--outer\n" +
+	"Content-Type: multipart/alternative; boundary=inner\n\n" +
+	"--inner\n" +
+	"Content-Type: text/plain; charset=utf-8\n" +
+	"Content-Transfer-Encoding: quoted-printable\n\n" +
+	"Caf=C3=A9 au lait.\n" +
+	"--inner\n" +
+	"Content-Type: text/html; charset=utf-8\n\n" +
+	"<p>Café au lait.</p>\n" +
+	"--inner--\n" +
+	"--outer\n" +
+	"Content-Type: application/octet-stream\n" +
+	"Content-Disposition: attachment; filename=\"data.bin\"\n" +
+	"Content-Transfer-Encoding: base64\n\n" +
+	"AAEC\nAwQ=\n" +
+	"--outer--\n"
+
+func TestWebhook(t *testing.T) {
+	secret := []byte("secret")
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies [][]byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Smtpd-Signature") != WebhookSignature(secret, r.Header.Get("X-Smtpd-Timestamp"), body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		if strings.Contains(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mu.Lock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	for _, format := range []WebhookFormat{WebhookRaw, WebhookJSON, WebhookMultipart} {
+		wh := &Webhook{URL: ts.URL, Format: format, Secret: secret}
+		server := &Server{Handler: wh.Deliver}
+		sendMessage(t, server, strings.Replace(strings.TrimSuffix(webhookTestMessage, "\n"), "\n", "\r\n", -1), 250)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("webhook received %d requests, want 3", len(requests))
+	}
+
+	raw := requests[0]
+	if raw.Header.Get("Content-Type") != "message/rfc822" || raw.Header.Get("X-Smtpd-From") != "sender@example.com" ||
+		raw.Header.Get("X-Smtpd-To") != "recipient@example.com" || string(bodies[0]) != webhookTestMessage {
+		t.Errorf("raw request is %v %q", raw.Header, bodies[0])
+	}
+
+	var m WebhookMessage
+	if err := json.Unmarshal(bodies[1], &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.From != "sender@example.com" || m.Subject != "Café" || m.Text != "Café au lait." || m.HTML != "<p>Café au lait.</p>" ||
+		len(m.Attachments) != 1 || m.Attachments[0].Filename != "data.bin" || string(m.Attachments[0].Content) != "\x00\x01\x02\x03\x04" {
+		t.Errorf("JSON request is %s", bodies[1])
+	}
+
+	form := requests[2].MultipartForm
+	if form.Value["subject"][0] != "Café" || form.Value["to"][0] != "recipient@example.com" ||
+		form.File["attachment1"][0].Filename != "data.bin" || form.File["attachment1"][0].Size != 5 {
+		t.Errorf("multipart request is %v %v", form.Value, form.File)
+	}
+}
+
+func TestWebhookStatus(t *testing.T) {
+	tests := []struct {
+		statuses []int
+		want     string
+		attempts int
+	}{
+		{[]int{200}, "", 1},
+		{[]int{503, 502, 204}, "", 3},
+		{[]int{500, 500, 500}, "451 4.3.0 ", 3},
+		{[]int{429, 429, 429}, "451 4.3.0 ", 3},
+		{[]int{422}, "554 5.6.0 ", 1},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.statuses[attempts])
+			attempts++
+		}))
+		wh := &Webhook{URL: ts.URL, RetryDelay: time.Millisecond}
+		err := wh.Deliver(nil, "sender@example.com", []string{"recipient@example.com"}, strings.NewReader("Subject: Test\n\nHello.\n"))
+		ts.Close()
+		if tt.want == "" && err != nil || tt.want != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.want)) {
+			t.Errorf("responses %v returned %v, want %q", tt.statuses, err, tt.want)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("responses %v took %d attempts, want %d", tt.statuses, attempts, tt.attempts)
+		}
+	}
+}
+
+func TestWebhookMaxElapsed(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(503)
+	}))
+	defer ts.Close()
+
+	wh := &Webhook{URL: ts.URL, Retries: 100, RetryDelay: 20 * time.Millisecond, MaxElapsed: 200 * time.Millisecond}
+	start := time.Now()
+	err := wh.Deliver(nil, "sender@example.com", []string{"recipient@example.com"}, strings.NewReader("Subject: Test\n\nHello.\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "451 4.3.0 ") {
+		t.Errorf("Deliver() returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Deliver() took %v", elapsed)
+	}
+	if attempts < 2 || attempts > 5 {
+		t.Errorf("took %d attempts", attempts)
+	}
+}